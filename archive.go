@@ -0,0 +1,74 @@
+package traefikgeoip2
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isArchive reports whether dbPath is a compressed database, a MaxMind .tar.gz or a gzipped .mmdb.
+func isArchive(dbPath string) bool {
+	return strings.HasSuffix(dbPath, ".tar.gz") || strings.HasSuffix(dbPath, ".tgz") || strings.HasSuffix(dbPath, ".gz")
+}
+
+// extractedPath returns the path in downloadDir the database in the archive is extracted to.
+func extractedPath(cfg *Config, archive string) string {
+	name := strings.NewReplacer("*", "", "?", "", "[", "", "]", "").Replace(filepath.Base(archive))
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		name = strings.TrimSuffix(name, ".tar.gz") + ".mmdb"
+	case strings.HasSuffix(name, ".tgz"):
+		name = strings.TrimSuffix(name, ".tgz") + ".mmdb"
+	default:
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	return filepath.Join(downloadDir(cfg), name)
+}
+
+// extractArchive extracts the database in archive to path.
+func extractArchive(archive, path string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(archive, ".tar.gz") || strings.HasSuffix(archive, ".tgz") {
+		return extractTarGz(f, path)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer gz.Close()
+	return writeFileAtomic(path, gz, nil)
+}
+
+// extractTarGz writes the .mmdb file found in the tar.gz stream to path.
+// The file is replaced atomically so readers never see a partial database.
+func extractTarGz(r io.Reader, path string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return errors.New("no .mmdb file in archive")
+		}
+		if err != nil {
+			return fmt.Errorf("%w", err)
+		}
+		if header.Typeflag == tar.TypeReg && strings.HasSuffix(header.Name, ".mmdb") {
+			return writeFileAtomic(path, archive, nil)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package traefikgeoip2
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/IncSW/geoip2"
+)
+
+// accessRules the places, autonomous systems and anonymizers requests are allowed from or
+// blocked from.
+type accessRules struct {
+	allowedCountries  map[string]bool
+	blockedCountries  map[string]bool
+	allowedContinents map[string]bool
+	blockedContinents map[string]bool
+	allowedRegions    map[string]bool
+	blockedRegions    map[string]bool
+	allowedCities     map[string]bool
+	blockedCities     map[string]bool
+	allowedASNs       map[string]bool
+	blockedASNs       map[string]bool
+	blockedASOrgs     []string
+	anonymizers       map[string]bool
+	geofences         []geofence
+	zones             []geoZone
+	zonesBlock        bool
+}
+
+// anonymizerNames the blockAnonymizers names in the order they are checked.
+var anonymizerNames = []string{"anonymous", "vpn", "torExitNode", "hostingProvider", "publicProxy", "residentialProxy"}
+
+// anonymizerFlags returns the Anonymous-IP flags by blockAnonymizers name.
+func anonymizerFlags(anonymous *geoip2.AnonymousIP) map[string]bool {
+	return map[string]bool{
+		"anonymous":        anonymous.IsAnonymous,
+		"vpn":              anonymous.IsAnonymousVPN,
+		"torExitNode":      anonymous.IsTorExitNode,
+		"hostingProvider":  anonymous.IsHostingProvider,
+		"publicProxy":      anonymous.IsPublicProxy,
+		"residentialProxy": anonymous.IsResidentialProxy,
+	}
+}
+
+// newAccessRules returns the rules of cfg, nil when there are none.
+func newAccessRules(cfg *Config, zones []geoZone) (*accessRules, error) {
+	rules := &accessRules{
+		allowedCountries: upperSet(cfg.AllowedCountries),
+		blockedCountries: upperSet(cfg.BlockedCountries),
+		allowedRegions:   upperSet(cfg.AllowedRegions),
+		blockedRegions:   upperSet(cfg.BlockedRegions),
+		allowedCities:    upperSet(cfg.AllowedCities),
+		blockedCities:    upperSet(cfg.BlockedCities),
+	}
+	var err error
+	if rules.allowedContinents, err = parseContinents("allowedContinents", cfg.AllowedContinents); err != nil {
+		return nil, err
+	}
+	if rules.blockedContinents, err = parseContinents("blockedContinents", cfg.BlockedContinents); err != nil {
+		return nil, err
+	}
+	if rules.allowedASNs, err = parseASNs("allowedAsns", cfg.AllowedASNs); err != nil {
+		return nil, err
+	}
+	if rules.blockedASNs, err = parseASNs("blockedAsns", cfg.BlockedASNs); err != nil {
+		return nil, err
+	}
+	for _, org := range cfg.BlockedASOrgs {
+		if org = strings.ToLower(strings.TrimSpace(org)); org != "" {
+			rules.blockedASOrgs = append(rules.blockedASOrgs, org)
+		}
+	}
+
+	known := anonymizerFlags(&geoip2.AnonymousIP{})
+	rules.anonymizers = make(map[string]bool, len(cfg.BlockAnonymizers))
+	for _, name := range cfg.BlockAnonymizers {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unsupported blockAnonymizers value `%s'", name)
+		}
+		rules.anonymizers[name] = true
+	}
+
+	if rules.geofences, err = newGeofences(cfg.Geofences); err != nil {
+		return nil, err
+	}
+
+	switch cfg.GeoZonesAction {
+	case "":
+	case GeofenceAllow, GeofenceBlock:
+		if len(zones) == 0 {
+			return nil, fmt.Errorf("geoZonesAction `%s' needs geoZonesPath", cfg.GeoZonesAction)
+		}
+		rules.zones, rules.zonesBlock = zones, cfg.GeoZonesAction == GeofenceBlock
+	default:
+		return nil, fmt.Errorf("unsupported geoZonesAction `%s'", cfg.GeoZonesAction)
+	}
+
+	if rules.empty() {
+		return nil, nil
+	}
+	return rules, nil
+}
+
+// empty reports whether there are no rules.
+func (r *accessRules) empty() bool {
+	return len(r.allowedCountries) == 0 && len(r.blockedCountries) == 0 &&
+		len(r.allowedContinents) == 0 && len(r.blockedContinents) == 0 &&
+		len(r.allowedRegions) == 0 && len(r.blockedRegions) == 0 &&
+		len(r.allowedCities) == 0 && len(r.blockedCities) == 0 &&
+		len(r.allowedASNs) == 0 && len(r.blockedASNs) == 0 && len(r.blockedASOrgs) == 0 &&
+		len(r.anonymizers) == 0 && len(r.geofences) == 0 && len(r.zones) == 0
+}
+
+// blocks returns why the client of record is blocked, "" when it is not. A value is blocked
+// when it is in the blocked list, or not in the allowed list when there is one, unknown
+// values included. Private addresses of skipPrivate are never blocked.
+func (r *accessRules) blocks(record *GeoIPResult) string {
+	if record.country == Private {
+		return ""
+	}
+	if country := strings.ToUpper(record.country); listBlocks(r.allowedCountries, r.blockedCountries, country) {
+		return "country " + country
+	}
+	if continent := record.Continent(); listBlocks(r.allowedContinents, r.blockedContinents, continent) {
+		return "continent " + continent
+	}
+	if region := r.regionBlocks(record); region != "" {
+		return "region " + region
+	}
+	if city := strings.ToUpper(record.city); listBlocks(r.allowedCities, r.blockedCities, city) {
+		return "city " + record.city
+	}
+	if asn := formatUint(uint64(record.asn)); listBlocks(r.allowedASNs, r.blockedASNs, asn) {
+		return "ASN " + asn
+	}
+	if len(r.blockedASOrgs) > 0 {
+		for _, name := range []string{record.asOrg, record.isp, record.organization} {
+			if name == "" {
+				continue
+			}
+			name = strings.ToLower(name)
+			for _, org := range r.blockedASOrgs {
+				if strings.Contains(name, org) {
+					return "AS organization " + org
+				}
+			}
+		}
+	}
+	if fence := r.geofenceBlocks(coordinateOf(record.location)); fence != "" {
+		return "geofence " + fence
+	}
+	if len(r.zones) > 0 {
+		zone := zoneOf(r.zones, coordinateOf(record.location))
+		switch {
+		case r.zonesBlock && zone != "":
+			return "zone " + zone
+		case !r.zonesBlock && zone == "":
+			return "outside of the zones"
+		}
+	}
+	if record.anonymous != nil && len(r.anonymizers) > 0 {
+		flags := anonymizerFlags(record.anonymous)
+		for _, name := range anonymizerNames {
+			if flags[name] && r.anonymizers[name] {
+				return "anonymizer " + name
+			}
+		}
+	}
+	return ""
+}
+
+// regionBlocks returns the ISO 3166-2 code of the subdivision of record that is blocked,
+// or its largest one when none is allowed, "" when the region is not blocked.
+func (r *accessRules) regionBlocks(record *GeoIPResult) string {
+	if len(r.allowedRegions) == 0 && len(r.blockedRegions) == 0 {
+		return ""
+	}
+	codes := record.subdivisionCodes
+	if len(codes) == 0 {
+		codes = []string{record.regionCode}
+	}
+	allowed := len(r.allowedRegions) == 0
+	for _, code := range codes {
+		code = strings.ToUpper(code)
+		if r.blockedRegions[code] {
+			return code
+		}
+		allowed = allowed || r.allowedRegions[code]
+	}
+	if allowed {
+		return ""
+	}
+	return firstNonEmpty(strings.ToUpper(codes[0]), Unknown)
+}
+
+// listBlocks reports whether value is blocked, or not allowed when there are allowed values.
+func listBlocks(allowed, blocked map[string]bool, value string) bool {
+	return blocked[value] || len(allowed) > 0 && !allowed[value]
+}
+
+// continents the continent codes of the databases.
+var continents = map[string]bool{"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true}
+
+// parseContinents parses the continent codes of option name.
+func parseContinents(name string, values []string) (map[string]bool, error) {
+	set := upperSet(values)
+	for continent := range set {
+		if !continents[continent] {
+			return nil, fmt.Errorf("unsupported %s value `%s'", name, continent)
+		}
+	}
+	return set, nil
+}
+
+// parseASNs parses the AS numbers of option name, with or without the `AS' prefix.
+func parseASNs(name string, values []string) (map[string]bool, error) {
+	asns := make(map[string]bool, len(values))
+	for _, value := range values {
+		number := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "AS")
+		asn, err := strconv.ParseUint(number, 10, 32)
+		if err != nil || asn == 0 {
+			return nil, fmt.Errorf("invalid %s value `%s'", name, value)
+		}
+		asns[formatUint(asn)] = true
+	}
+	return asns, nil
+}
+
+// blockResponse the response to blocked requests.
+type blockResponse struct {
+	status      int
+	body        string
+	contentType string
+	link        string
+	page        *htmltemplate.Template
+	redirect    *template.Template
+	tag         bool
+}
+
+// redirectFuncs the functions of the blockRedirectUrl template.
+var redirectFuncs = template.FuncMap{"query": url.QueryEscape}
+
+// newBlockResponse returns the response of cfg, the body defaults to the status text.
+func newBlockResponse(cfg *Config) (blockResponse, error) {
+	response := blockResponse{status: cfg.BlockStatus, body: cfg.BlockBody, contentType: cfg.BlockContentType}
+	if response.status == 0 {
+		response.status = http.StatusForbidden
+	}
+	if response.status < 400 || response.status > 599 {
+		return blockResponse{}, fmt.Errorf("invalid blockStatus %d", cfg.BlockStatus)
+	}
+	if response.body == "" {
+		response.body = http.StatusText(response.status) + "\n"
+	}
+	if cfg.BlockTemplate != "" {
+		if cfg.BlockBody != "" {
+			return blockResponse{}, fmt.Errorf("blockTemplate and blockBody are exclusive")
+		}
+		page, err := htmltemplate.New("blockTemplate").Funcs(htmltemplate.FuncMap{"query": url.QueryEscape}).Option("missingkey=zero").Parse(cfg.BlockTemplate)
+		if err != nil {
+			return blockResponse{}, fmt.Errorf("invalid blockTemplate: %w", err)
+		}
+		response.page = page
+		if response.contentType == "" {
+			response.contentType = DefaultBlockTemplateContentType
+		}
+	}
+	if response.contentType == "" {
+		response.contentType = DefaultBlockContentType
+	}
+	if cfg.BlockedBy != "" {
+		if by, err := url.Parse(cfg.BlockedBy); err != nil || !by.IsAbs() {
+			return blockResponse{}, fmt.Errorf("invalid blockedBy URL `%s'", cfg.BlockedBy)
+		}
+		response.link = "<" + cfg.BlockedBy + `>; rel="blocked-by"`
+	}
+
+	switch cfg.BlockAction {
+	case "", BlockActionReject:
+	case BlockActionTag:
+		response.tag = true
+	case BlockActionRedirect:
+		if cfg.BlockRedirectURL == "" {
+			return blockResponse{}, fmt.Errorf("blockAction `%s' needs blockRedirectUrl", cfg.BlockAction)
+		}
+		tmpl, err := template.New("blockRedirectUrl").Funcs(redirectFuncs).Option("missingkey=zero").Parse(cfg.BlockRedirectURL)
+		if err != nil {
+			return blockResponse{}, fmt.Errorf("invalid blockRedirectUrl template: %w", err)
+		}
+		response.redirect = tmpl
+	default:
+		return blockResponse{}, fmt.Errorf("unsupported blockAction `%s'", cfg.BlockAction)
+	}
+	return response, nil
+}
+
+// block rejects req of the client at ip of record with the blockResponse, linking the
+// blockedBy entity, or redirects it to the blockRedirectUrl with the redirect blockAction.
+// The blockTemplate gets the templateValues with the client `IP`, the `Rule` blocking it,
+// the `Status` and the Accept-Language of the request as `Language`.
+func (mw *TraefikGeoIP2) block(rw http.ResponseWriter, req *http.Request, ip net.IP, record *GeoIPResult, reason string) {
+	logInfo.Printf("Blocked request for %s from %s", req.URL.Path, reason)
+	if mw.blocked.redirect != nil {
+		var target strings.Builder
+		err := mw.blocked.redirect.Execute(&target, mw.templateValues(record))
+		if err == nil {
+			http.Redirect(rw, req, strings.TrimSpace(target.String()), http.StatusFound)
+			return
+		}
+		logWarn.Printf("blockRedirectUrl template failed: %v", err)
+	}
+	body := mw.blocked.body
+	if mw.blocked.page != nil {
+		page := mw.templateValues(record)
+		page["Rule"], page["Status"] = reason, strconv.Itoa(mw.blocked.status)
+		page["Language"] = req.Header.Get(AcceptLanguageHeader)
+		if ip != nil {
+			page["IP"] = ip.String()
+		}
+		var buf bytes.Buffer
+		if err := mw.blocked.page.Execute(&buf, page); err == nil {
+			body = buf.String()
+		} else {
+			logWarn.Printf("blockTemplate failed: %v", err)
+		}
+	}
+	rw.Header().Set("Content-Type", mw.blocked.contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if mw.blocked.link != "" {
+		rw.Header().Add(LinkHeader, mw.blocked.link)
+	}
+	rw.WriteHeader(mw.blocked.status)
+	if req.Method != http.MethodHead {
+		_, _ = io.WriteString(rw, body)
+	}
+}
+
+// upperSet returns the set of values in upper case.
+func upperSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToUpper(strings.TrimSpace(value))] = true
+	}
+	return set
+}
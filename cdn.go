@@ -0,0 +1,107 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cdnPreset the client IP header of a CDN and the networks it sends requests from.
+type cdnPreset struct {
+	header string
+	// port is set when the header value ends with the client port.
+	port     bool
+	ranges   []string
+	networks []*net.IPNet
+}
+
+// cdnPresets by ipStrategy, in the order auto tries them. Akamai and CloudFront publish no
+// fixed ranges, their header is only trusted from the configured trustedProxies.
+var cdnPresets = []struct {
+	name   string
+	preset cdnPreset
+}{
+	{name: IPStrategyCloudflare, preset: cdnPreset{
+		header: "CF-Connecting-IP",
+		ranges: []string{
+			"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+			"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+			"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+			"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+			"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+			"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+		},
+	}},
+	{name: IPStrategyFastly, preset: cdnPreset{
+		header: "Fastly-Client-IP",
+		ranges: []string{
+			"23.235.32.0/20", "43.249.72.0/22", "103.244.50.0/24", "103.245.222.0/23",
+			"103.245.224.0/24", "104.156.80.0/20", "140.248.64.0/18", "140.248.128.0/17",
+			"146.75.0.0/17", "151.101.0.0/16", "157.52.64.0/18", "167.82.0.0/17",
+			"167.82.128.0/20", "167.82.160.0/20", "167.82.224.0/20", "172.111.64.0/18",
+			"185.31.16.0/22", "199.27.72.0/21", "199.232.0.0/16",
+			"2a04:4e40::/32", "2a04:4e42::/32",
+		},
+	}},
+	{name: IPStrategyAkamai, preset: cdnPreset{header: "True-Client-IP"}},
+	{name: IPStrategyCloudFront, preset: cdnPreset{header: "CloudFront-Viewer-Address", port: true}},
+}
+
+// newCDNPresets returns the presets of strategy, all of them for auto. Presets without
+// published ranges use the networks of trustedProxies and need them, auto skips them
+// without.
+func newCDNPresets(strategy string, trustedProxies []*net.IPNet) ([]cdnPreset, error) {
+	if strategy == "" {
+		return nil, nil
+	}
+
+	var presets []cdnPreset
+	for _, entry := range cdnPresets {
+		if strategy != IPStrategyAuto && strategy != entry.name {
+			continue
+		}
+		preset := entry.preset
+		if len(preset.ranges) == 0 {
+			switch {
+			case len(trustedProxies) > 0:
+				preset.networks = trustedProxies
+				presets = append(presets, preset)
+			case strategy != IPStrategyAuto:
+				return nil, fmt.Errorf("ipStrategy `%s' needs trustedProxies", strategy)
+			}
+			continue
+		}
+		networks, err := parseCIDRs("ipStrategy", preset.ranges)
+		if err != nil {
+			return nil, err
+		}
+		preset.networks = networks
+		presets = append(presets, preset)
+	}
+	if len(presets) == 0 {
+		return nil, fmt.Errorf("unsupported ipStrategy `%s'", strategy)
+	}
+	return presets, nil
+}
+
+// cdnIP returns the client IP the CDN in front of the request reports, "" when the request
+// does not come from one of the CDNs.
+func (mw *TraefikGeoIP2) cdnIP(req *http.Request, remote string) string {
+	remoteAddr := net.ParseIP(remote)
+	for _, preset := range mw.cdns {
+		if !containsIP(preset.networks, remoteAddr) {
+			continue
+		}
+		value := req.Header.Get(preset.header)
+		if preset.port {
+			if i := strings.LastIndex(value, ":"); i >= 0 {
+				value = value[:i]
+			}
+		}
+		if ip := parseAddr(value); ip != nil && !isPrivateIP(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
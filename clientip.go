@@ -0,0 +1,234 @@
+package traefikgeoip2
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client req is looked up for: the IP reported by a CDN
+// of the ipStrategy, the first public IP in the configured IP headers, the X-Forwarded-For
+// hop picked by the configured depth or the remote address.
+// Request headers are ignored with preferRemoteAddr or when the request does not come
+// from one of the trusted proxies. With the flag spoofPolicy, headers of other requests
+// are used, but reported as suspected spoofing when they name a different address.
+func (mw *TraefikGeoIP2) clientIP(req *http.Request) (string, bool) {
+	remote := normalizeAddr(req.RemoteAddr)
+	if mw.remoteOnly {
+		return remote, false
+	}
+	if ip := mw.cdnIP(req, remote); ip != "" {
+		return ip, false
+	}
+
+	ip := mw.headerIP(req)
+	switch {
+	case ip == "":
+		return remote, false
+	case mw.trustedProxy(remote):
+		return ip, false
+	case mw.spoofPolicy == SpoofFlag:
+		return ip, ip != remote
+	default:
+		return remote, false
+	}
+}
+
+// headerIP returns the client IP in the request headers, "" when there is none. Private
+// addresses are skipped in the ipHeaders, the single ipHeader is taken as is.
+func (mw *TraefikGeoIP2) headerIP(req *http.Request) string {
+	for _, header := range mw.ipHeaders {
+		if ip := parseAddr(req.Header.Get(header)); ip != nil && !(mw.skipPrivateHeaders && isPrivateIP(ip)) {
+			return ip.String()
+		}
+	}
+	return mw.forwardedFor(req.Header.Values(ForwardedForHeader))
+}
+
+// trustedProxy reports whether headers sent by ip are trusted, any ip is when no trusted
+// proxies are configured.
+func (mw *TraefikGeoIP2) trustedProxy(ip string) bool {
+	if len(mw.trusted) == 0 {
+		return true
+	}
+	return containsIP(mw.trusted, net.ParseIP(ip))
+}
+
+// privateNetworks are the RFC 1918 networks and IPv6 unique local addresses.
+var privateNetworks = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0).To4(), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// isPrivateIP reports whether ip is a private, loopback, link-local or unspecified address,
+// which no database has an entry for.
+func isPrivateIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || containsIP(privateNetworks, ip)
+}
+
+// containsIP reports whether one of networks contains ip.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses the networks of option name, a single address is a network of its own.
+func parseCIDRs(name string, values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s address `%s'", name, value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s network `%s': %w", name, value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// forwardedFor returns the entry of the X-Forwarded-For chain picked by the select strategy,
+// "" when there is none.
+func (mw *TraefikGeoIP2) forwardedFor(values []string) string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return ""
+	}
+
+	switch mw.xffStrategy {
+	case SelectFirstPublic:
+		for _, hop := range hops {
+			if ip := parseAddr(hop); ip != nil && !isPrivateIP(ip) {
+				return ip.String()
+			}
+		}
+		return ""
+	case SelectLast:
+		return normalizeAddr(hops[len(hops)-1])
+	default:
+		return forwardedForDepth(hops, mw.xffDepth)
+	}
+}
+
+// forwardedForDepth returns the hop added by the proxy depth hops away, the right-most one
+// with depth 1. Hops left of it can be set by the client and are only used when the chain
+// is shorter than depth. It returns "" when depth is 0.
+func forwardedForDepth(hops []string, depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	if depth > len(hops) {
+		depth = len(hops)
+	}
+	return normalizeAddr(hops[len(hops)-depth])
+}
+
+// normalizeAddr returns the canonical form of the IP in value, value itself when there is none,
+// so that one client is cached under a single key.
+func normalizeAddr(value string) string {
+	if ip := parseAddr(value); ip != nil {
+		return ip.String()
+	}
+	return value
+}
+
+// parseAddr parses an IP with or without port, an IPv6 address may be in brackets and have
+// a zone, e.g. `[fe80::1%eth0]:443`. IPv4-mapped IPv6 addresses like `::ffff:203.0.113.9`
+// are returned in their IPv4 form. It returns nil when value holds no IP.
+func parseAddr(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if i := strings.IndexByte(value, '%'); i >= 0 {
+		value = value[:i]
+	}
+	ip := net.ParseIP(value)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// debugOverride lets callers knowing the secret choose the IP that is looked up, in a
+// request header or a query parameter. The secret is only taken from DebugSecretHeader,
+// query strings end up in access logs and browser histories.
+type debugOverride struct {
+	header string
+	query  string
+	secret string
+}
+
+// ip returns the IP the caller asked for, "" when there is none or the secret does not match.
+// The debug headers and query parameters, and a secret sent in the query by mistake, are
+// removed from req so they are not passed on to the backend.
+func (o debugOverride) ip(req *http.Request) string {
+	if o.header == "" && o.query == "" {
+		return ""
+	}
+
+	var value string
+	if o.header != "" {
+		value = req.Header.Get(o.header)
+		req.Header.Del(o.header)
+	}
+	query := req.URL.Query()
+	if value == "" && o.query != "" {
+		value = query.Get(o.query)
+	}
+	secret := req.Header.Get(DebugSecretHeader)
+	req.Header.Del(DebugSecretHeader)
+	if _, ok := query[DebugSecretParam]; ok || o.query != "" && query[o.query] != nil {
+		query.Del(DebugSecretParam)
+		if o.query != "" {
+			query.Del(o.query)
+		}
+		req.URL.RawQuery = query.Encode()
+		if req.RequestURI != "" {
+			req.RequestURI = req.URL.RequestURI()
+		}
+	}
+
+	if value == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(o.secret)) != 1 {
+		return ""
+	}
+	ip := parseAddr(value)
+	if ip == nil {
+		return ""
+	}
+	logInfo.Printf("Debug override of the client IP with %s", ip)
+	return ip.String()
+}
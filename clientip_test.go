@@ -0,0 +1,473 @@
+package traefikgeoip2_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mw "github.com/sopov/traefikgeoip2"
+)
+
+// newClientIPInstance creates an instance over a City database knowing ValidIP in Munich
+// and 81.2.69.0/24 and 2001:db8::/32 in London.
+func newClientIPInstance(t *testing.T, configure func(cfg *mw.Config)) http.Handler {
+	t.Helper()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		"81.2.69.0/24":    testCityRecord("GB", "England", "London"),
+		"2001:db8::/32":   testCityRecord("GB", "England", "London"),
+	})
+	configure(mwCfg)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	return instance
+}
+
+func TestGeoIPForwardedFor(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.ForwardedForDepth = 2
+	})
+
+	tests := []struct {
+		name     string
+		xff      []string
+		expected string
+	}{
+		{name: "spoofed left-most hop", xff: []string{"81.2.69.1, " + ValidIP + ", 10.0.0.1"}, expected: "Munich"},
+		{name: "multiple headers", xff: []string{"81.2.69.1", ValidIP, "10.0.0.1"}, expected: "Munich"},
+		{name: "shorter chain", xff: []string{"81.2.69.1"}, expected: "London"},
+		{name: "no header", expected: "Munich"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = ValidIPAndPort
+			for _, value := range test.xff {
+				req.Header.Add(mw.ForwardedForHeader, value)
+			}
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+		})
+	}
+
+	for _, strategy := range []string{mw.IPStrategyAkamai, mw.IPStrategyCloudFront} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.IPStrategy = strategy
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Errorf("ipStrategy %s must fail without trustedProxies", strategy)
+		}
+	}
+}
+
+func TestGeoIPForwardedForDisabled(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.ForwardedForHeader, "81.2.69.1")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPIPHeader(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.IPHeader = "CF-Connecting-IP"
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.RealIPHeader, ValidIP)
+	req.Header.Set("CF-Connecting-IP", "81.2.69.1")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "London")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.1:9999"
+	req.Header.Set(mw.RealIPHeader, ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "London")
+}
+
+func TestGeoIPPreferRemoteAddr(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.PreferRemoteAddr = true
+		cfg.ForwardedForDepth = 1
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.RealIPHeader, "81.2.69.1")
+	req.Header.Set(mw.ForwardedForHeader, "81.2.69.1")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPTrustedProxies(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+		cfg.ForwardedForDepth = 1
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		expected   string
+	}{
+		{name: "trusted network", remoteAddr: "10.1.2.3:9999", header: mw.RealIPHeader, expected: "London"},
+		{name: "trusted address", remoteAddr: "192.0.2.1:9999", header: mw.ForwardedForHeader, expected: "London"},
+		{name: "untrusted real IP", remoteAddr: ValidIPAndPort, header: mw.RealIPHeader, expected: "Munich"},
+		{name: "untrusted forwarded for", remoteAddr: ValidIPAndPort, header: mw.ForwardedForHeader, expected: "Munich"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set(test.header, "81.2.69.1")
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+		})
+	}
+}
+
+func TestGeoIPInvalidTrustedProxies(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.TrustedProxies = []string{"10.0.0.0/33"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid trustedProxies")
+	}
+}
+
+func TestGeoIPSkipPrivate(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.SkipPrivate = true
+	})
+
+	for _, addr := range []string{"10.1.2.3:80", "192.168.0.1:80", "127.0.0.1:80", "[::1]:80", "[fe80::1]:80", "[fd00::1]:80"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = addr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, mw.Private)
+		assertHeader(t, req, mw.CityHeader, mw.Private)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPIPHeaders(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.IPHeaders = []string{"CF-Connecting-IP", "True-Client-IP", mw.RealIPHeader}
+	})
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{name: "first header", headers: map[string]string{"CF-Connecting-IP": "81.2.69.1", mw.RealIPHeader: ValidIP}, expected: "London"},
+		{name: "later header", headers: map[string]string{"True-Client-IP": "81.2.69.1"}, expected: "London"},
+		{name: "unparseable", headers: map[string]string{"CF-Connecting-IP": "unknown", mw.RealIPHeader: "81.2.69.1"}, expected: "London"},
+		{name: "private", headers: map[string]string{"CF-Connecting-IP": "10.0.0.1", "True-Client-IP": "81.2.69.1"}, expected: "London"},
+		{name: "none", headers: map[string]string{"CF-Connecting-IP": "10.0.0.1"}, expected: "Munich"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = ValidIPAndPort
+			for header, value := range test.headers {
+				req.Header.Set(header, value)
+			}
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+		})
+	}
+}
+
+func TestGeoIPPrivateIPHeader(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.SkipPrivate = true
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.RealIPHeader, "10.0.0.1")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, mw.Private)
+}
+
+func TestGeoIPIPv6Addresses(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {})
+
+	for _, addr := range []string{"[2001:db8::1]:443", "[2001:db8::1]", "2001:db8::1", "[2001:db8::1%eth0]:443", "2001:db8::1%eth0", "2001:DB8:0::1"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = addr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CityHeader, "London")
+
+		req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		req.Header.Set(mw.RealIPHeader, addr)
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CityHeader, "London")
+	}
+}
+
+func TestGeoIPSelectStrategy(t *testing.T) {
+	xff := "10.0.0.1, 81.2.69.1, 172.16.0.1, " + ValidIP + ", 192.168.0.1"
+	tests := []struct {
+		strategy string
+		xff      string
+		expected string
+	}{
+		{strategy: mw.SelectFirstPublic, xff: xff, expected: "London"},
+		{strategy: mw.SelectFirstPublic, xff: "10.0.0.1, unknown", expected: "Munich"},
+		{strategy: mw.SelectLast, xff: "81.2.69.1, " + ValidIP, expected: "Munich"},
+		{strategy: mw.SelectLast, xff: ValidIP + ", 81.2.69.1", expected: "London"},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			instance := newClientIPInstance(t, func(cfg *mw.Config) {
+				cfg.SelectStrategy = test.strategy
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = ValidIPAndPort
+			req.Header.Set(mw.ForwardedForHeader, test.xff)
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+		})
+	}
+}
+
+func TestGeoIPDebugOverride(t *testing.T) {
+	var forwarded http.Header
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		"81.2.69.0/24":    testCityRecord("GB", "England", "London"),
+	})
+	mwCfg.DebugOverrideHeader = "X-Debug-IP"
+	mwCfg.DebugOverrideQuery = "debugIp"
+	mwCfg.DebugOverrideSecret = "s3cr3t"
+
+	var forwardedURI string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Clone()
+		forwardedURI = req.URL.String() + " " + req.RequestURI
+	})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		headers  map[string]string
+		expected string
+	}{
+		{name: "header", url: "http://localhost", headers: map[string]string{"X-Debug-IP": "81.2.69.1", mw.DebugSecretHeader: "s3cr3t"}, expected: "London"},
+		{name: "query", url: "http://localhost?debugIp=81.2.69.1", headers: map[string]string{mw.DebugSecretHeader: "s3cr3t"}, expected: "London"},
+		{name: "query with others", url: "http://localhost/page?q=1&debugIp=81.2.69.1", headers: map[string]string{mw.DebugSecretHeader: "s3cr3t"}, expected: "London"},
+		{name: "query secret", url: "http://localhost?debugIp=81.2.69.1&geoip2Secret=s3cr3t", expected: "Munich"},
+		{name: "wrong secret in query", url: "http://localhost?debugIp=81.2.69.1&geoip2Secret=guess", expected: "Munich"},
+		{name: "wrong secret", url: "http://localhost", headers: map[string]string{"X-Debug-IP": "81.2.69.1", mw.DebugSecretHeader: "guess"}, expected: "Munich"},
+		{name: "no secret", url: "http://localhost?debugIp=81.2.69.1", expected: "Munich"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.RemoteAddr = ValidIPAndPort
+			for header, value := range test.headers {
+				req.Header.Set(header, value)
+			}
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+			if forwarded.Get("X-Debug-IP") != "" || forwarded.Get(mw.DebugSecretHeader) != "" {
+				t.Fatalf("Debug headers must not be passed on: %v", forwarded)
+			}
+			if strings.Contains(forwardedURI, "debugIp") || strings.Contains(forwardedURI, mw.DebugSecretParam) || strings.Contains(forwardedURI, "guess") {
+				t.Fatalf("Debug query parameters must not be passed on: %s", forwardedURI)
+			}
+			if strings.Contains(test.url, "q=1") && !strings.Contains(forwardedURI, "/page?q=1") {
+				t.Fatalf("Other query parameters must be passed on: %s", forwardedURI)
+			}
+		})
+	}
+
+	mwCfg.DebugOverrideSecret = ""
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail without debugOverrideSecret")
+	}
+}
+
+func TestGeoIPStrategyPresets(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategy   string
+		trusted    []string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name: "cloudflare", strategy: mw.IPStrategyCloudflare, remoteAddr: "173.245.48.1:443",
+			headers: map[string]string{"CF-Connecting-IP": "81.2.69.1"}, expected: "London",
+		},
+		{
+			name: "not from cloudflare", strategy: mw.IPStrategyCloudflare, remoteAddr: ValidIPAndPort,
+			headers: map[string]string{"CF-Connecting-IP": "81.2.69.1"}, expected: "Munich",
+		},
+		{
+			name: "cloudfront", strategy: mw.IPStrategyCloudFront, trusted: []string{"10.0.0.0/8"}, remoteAddr: "10.1.2.3:443",
+			headers: map[string]string{"CloudFront-Viewer-Address": "2001:db8::1:46532"}, expected: "London",
+		},
+		{
+			name: "auto", strategy: mw.IPStrategyAuto, remoteAddr: "151.101.1.1:443",
+			headers: map[string]string{"CF-Connecting-IP": "81.2.69.1", "Fastly-Client-IP": ValidIP}, expected: "Munich",
+		},
+		{
+			name: "auto akamai untrusted", strategy: mw.IPStrategyAuto, remoteAddr: ValidIPAndPort,
+			headers: map[string]string{"True-Client-IP": "81.2.69.1"}, expected: "Munich",
+		},
+		{
+			name: "auto akamai from cloudflare", strategy: mw.IPStrategyAuto, trusted: []string{"10.0.0.0/8"}, remoteAddr: "173.245.48.1:443",
+			headers: map[string]string{"True-Client-IP": "81.2.69.1", mw.RealIPHeader: "81.2.69.1"}, expected: mw.Unknown,
+		},
+		{
+			name: "cloudflare ip headers", strategy: mw.IPStrategyCloudflare, trusted: []string{"10.0.0.0/8"}, remoteAddr: "173.245.48.1:443",
+			headers: map[string]string{mw.RealIPHeader: "81.2.69.1"}, expected: mw.Unknown,
+		},
+		{
+			name: "cloudflare without trustedProxies", strategy: mw.IPStrategyCloudflare, remoteAddr: "10.1.2.3:443",
+			headers: map[string]string{mw.RealIPHeader: ValidIP}, expected: "Munich",
+		},
+		{
+			name: "auto akamai trusted", strategy: mw.IPStrategyAuto, trusted: []string{"10.0.0.0/8"}, remoteAddr: "10.1.2.3:443",
+			headers: map[string]string{"True-Client-IP": "81.2.69.1"}, expected: "London",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := newClientIPInstance(t, func(cfg *mw.Config) {
+				cfg.IPStrategy = test.strategy
+				cfg.TrustedProxies = test.trusted
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = test.remoteAddr
+			for header, value := range test.headers {
+				req.Header.Set(header, value)
+			}
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+		})
+	}
+}
+
+func TestGeoIPIPv4MappedAddresses(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {})
+
+	for _, addr := range []string{"[::ffff:" + ValidIP + "]:443", "::ffff:" + ValidIP, "[::FFFF:bcc1:58c7]:443"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = addr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CityHeader, "Munich")
+
+		req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "81.2.69.1:443"
+		req.Header.Set(mw.RealIPHeader, addr)
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CityHeader, "Munich")
+	}
+}
+
+func TestGeoIPInvalidAddrPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{policy: mw.InvalidAddrUnknown, expected: mw.Unknown},
+		{policy: mw.InvalidAddrSkip, expected: ""},
+		{policy: mw.InvalidAddrPrivate, expected: mw.Private},
+		{policy: mw.InvalidAddrFallback, expected: "Munich"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			instance := newClientIPInstance(t, func(cfg *mw.Config) {
+				cfg.InvalidAddrPolicy = test.policy
+				cfg.InvalidAddrIP = ValidIP
+			})
+
+			for _, addr := range []string{"@", "", "garbage:80"} {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				req.RemoteAddr = addr
+				instance.ServeHTTP(httptest.NewRecorder(), req)
+				assertHeader(t, req, mw.CityHeader, test.expected)
+			}
+		})
+	}
+}
+
+func TestGeoIPSpoofPolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		remoteAddr string
+		expected   string
+		suspected  string
+	}{
+		{policy: mw.SpoofIgnore, remoteAddr: ValidIPAndPort, expected: "Munich"},
+		{policy: mw.SpoofFlag, remoteAddr: ValidIPAndPort, expected: "London", suspected: "true"},
+		{policy: mw.SpoofFlag, remoteAddr: "10.1.2.3:9999", expected: "London"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy+" "+test.remoteAddr, func(t *testing.T) {
+			instance := newClientIPInstance(t, func(cfg *mw.Config) {
+				cfg.TrustedProxies = []string{"10.0.0.0/8"}
+				cfg.SpoofPolicy = test.policy
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set(mw.RealIPHeader, "81.2.69.1")
+			req.Header.Set(mw.SpoofSuspectedHeader, "false")
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			assertHeader(t, req, mw.CityHeader, test.expected)
+			assertHeader(t, req, mw.SpoofSuspectedHeader, test.suspected)
+		})
+	}
+}
+
+func TestGeoIPPeerLookup(t *testing.T) {
+	instance := newClientIPInstance(t, func(cfg *mw.Config) {
+		cfg.PeerLookup = true
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.RealIPHeader, "81.2.69.1")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "London")
+	assertHeader(t, req, mw.PeerCountryHeader, "DE")
+	assertHeader(t, req, mw.PeerCityHeader, "Munich")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "@"
+	req.Header.Set(mw.PeerCountryHeader, "US")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.PeerCountryHeader, "")
+}
@@ -0,0 +1,89 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GeoCookie settings of the cookie with the country and region of the client.
+type GeoCookie struct {
+	Name     string `json:"name,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	SameSite string `json:"sameSite,omitempty"`
+}
+
+// geoCookie the cookie issued to clients, nil without a cookie name.
+type geoCookie struct {
+	name     string
+	maxAge   int
+	domain   string
+	path     string
+	secure   bool
+	httpOnly bool
+	sameSite http.SameSite
+}
+
+// newGeoCookie validates the cookie settings.
+func newGeoCookie(cfg GeoCookie) (*geoCookie, error) {
+	if cfg.Name == "" {
+		return nil, nil
+	}
+	ttl, err := parseInterval("cookie ttl", cfg.TTL)
+	if err != nil {
+		return nil, err
+	}
+	cookie := &geoCookie{
+		name:     cfg.Name,
+		maxAge:   int(ttl / time.Second),
+		domain:   cfg.Domain,
+		path:     firstNonEmpty(cfg.Path, "/"),
+		secure:   cfg.Secure,
+		httpOnly: cfg.HTTPOnly,
+	}
+	switch strings.ToLower(cfg.SameSite) {
+	case "":
+	case "lax":
+		cookie.sameSite = http.SameSiteLaxMode
+	case "strict":
+		cookie.sameSite = http.SameSiteStrictMode
+	case "none":
+		cookie.sameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unsupported cookie sameSite `%s'", cfg.SameSite)
+	}
+	return cookie, nil
+}
+
+// set issues the cookie with the country and region of values, e.g. `country=DE&region=Bavaria`.
+// Clients already holding the same value do not get it again.
+// The cookie is only ever written: its content comes from the client on later requests
+// and so is not used for the lookup.
+func (c *geoCookie) set(rw http.ResponseWriter, req *http.Request, values []geoValue) {
+	query := url.Values{}
+	for _, value := range values {
+		if value.name == "country" || value.name == "region" {
+			query.Set(value.name, value.value)
+		}
+	}
+	content := query.Encode()
+	if current, err := req.Cookie(c.name); err == nil && current.Value == content {
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     c.name,
+		Value:    content,
+		MaxAge:   c.maxAge,
+		Domain:   c.domain,
+		Path:     c.path,
+		Secure:   c.secure,
+		HttpOnly: c.httpOnly,
+		SameSite: c.sameSite,
+	})
+}
@@ -0,0 +1,571 @@
+package traefikgeoip2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IncSW/geoip2"
+	"github.com/patrickmn/go-cache"
+)
+
+// database is a GeoIP2 database the middleware looks up.
+type database struct {
+	path     string
+	dbType   string
+	mode     string
+	checksum string
+	fields   map[string]string
+	parts    recordParts
+	archive  string
+	upd      *updater
+	schedule dbSchedule
+
+	current atomic.Value // *dbVersion in use, swapped without blocking lookups
+
+	// ctx lives while instances share the database, its background jobs stop with it.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu       sync.Mutex
+	caches   []*cache.Cache
+	lastOpen time.Time
+	jobs     map[string]bool
+}
+
+// dbSchedule the intervals of the background jobs of a database and the age it is stale at,
+// the instances sharing the database have them in common. Disabled jobs are 0.
+type dbSchedule struct {
+	retry  time.Duration
+	watch  time.Duration
+	reload time.Duration
+	update time.Duration
+	jitter time.Duration
+	maxAge time.Duration
+}
+
+// dbVersion is a version of the database opened from the file on disk.
+type dbVersion struct {
+	path   string
+	lookup LookupGeoIP2
+	meta   dbMetadata
+	state  dbState
+}
+
+// dbMetadata describes the version of a database that is in use.
+type dbMetadata struct {
+	databaseType string
+	buildTime    time.Time
+	nodeCount    uint64
+}
+
+func newDBMetadata(buffer []byte) dbMetadata {
+	var meta dbMetadata
+	metadata, _ := readMetadata(buffer)
+	if epoch, ok := metadata["build_epoch"].(uint64); ok {
+		meta.buildTime = time.Unix(int64(epoch), 0)
+	}
+	meta.databaseType, _ = metadata["database_type"].(string)
+	meta.nodeCount, _ = metadata["node_count"].(uint64)
+	return meta
+}
+
+// newDatabases creates the databases listed in the configuration.
+// A MaxMind edition downloaded with a license key is used in place of dbPath.
+func newDatabases(cfg *Config) []*database {
+	var dbs []*database
+	if cfg.LicenseKey != "" {
+		upd := newMaxMindUpdater(cfg)
+		dbs = append(dbs, &database{path: upd.path, dbType: DBTypeAuto, mode: cfg.DBMode, fields: cfg.Fields, upd: upd})
+	}
+
+	paths := cfg.DBPaths
+	checksum := ""
+	if len(paths) == 0 && cfg.LicenseKey == "" {
+		paths = []string{cfg.DBPath}
+		checksum = cfg.DBChecksum
+	}
+	for _, path := range paths {
+		dbs = append(dbs, newDatabase(cfg, path, checksum))
+	}
+	return dbs
+}
+
+// newDatabase creates the database at path, a local file, archive or URL.
+func newDatabase(cfg *Config, path, checksum string) *database {
+	path = os.ExpandEnv(path)
+	db := &database{path: path, dbType: cfg.DBType, mode: cfg.DBMode, checksum: checksum, fields: cfg.Fields}
+	switch {
+	case isRemote(path):
+		db.upd = newURLUpdater(cfg, path)
+		db.path = db.upd.path
+	case isArchive(path):
+		db.archive = path
+		db.path = extractedPath(cfg, path)
+	}
+	return db
+}
+
+// open downloads the database if it is remote and opens it.
+func (db *database) open() error {
+	if db.upd != nil {
+		if _, err := db.upd.update(); err != nil {
+			logErr.Printf("GeoIP DB `%s' not downloaded: %v", db.upd.url, err)
+		}
+	}
+
+	source := db.source()
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("GeoIP DB `%s' not found: %w", source, err)
+	}
+
+	version, err := db.load(source, info)
+	if err != nil {
+		return fmt.Errorf("GeoIP DB `%s' not initialized: %w", db.path, err)
+	}
+	db.setVersion(version)
+	return nil
+}
+
+// openOnDemand opens the database on a request, at most once per interval so that
+// requests do not wait on a database that keeps failing. It reports whether it opened it.
+func (db *database) openOnDemand(interval time.Duration) bool {
+	db.mu.Lock()
+	if !db.lastOpen.IsZero() && time.Since(db.lastOpen) < interval {
+		db.mu.Unlock()
+		return false
+	}
+	db.lastOpen = time.Now()
+	db.mu.Unlock()
+
+	if err := db.open(); err != nil {
+		logWarn.Print(err)
+		return false
+	}
+	return true
+}
+
+// source returns the file the database is opened from, the archive it is extracted from
+// if any. The newest file is used when the path is a glob pattern.
+func (db *database) source() string {
+	if db.archive != "" {
+		return newestMatch(db.archive)
+	}
+	return newestMatch(db.path)
+}
+
+// load opens the database from source, extracting it first if source is an archive.
+func (db *database) load(source string, info os.FileInfo) (*dbVersion, error) {
+	path := source
+	if db.archive != "" {
+		if err := extractArchive(source, db.path); err != nil {
+			return nil, fmt.Errorf("not extracted from `%s': %w", source, err)
+		}
+		path = db.path
+	}
+
+	lookup, meta, err := db.openLookup(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dbVersion{path: path, lookup: lookup, meta: meta, state: newDBState(source, info)}, nil
+}
+
+// newestMatch returns the most recently modified file matching the glob pattern,
+// pattern itself when nothing matches or it has no wildcards.
+func newestMatch(pattern string) string {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return pattern
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return pattern
+	}
+
+	newest, newestTime := pattern, time.Time{}
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if info.ModTime().After(newestTime) || info.ModTime().Equal(newestTime) && match > newest {
+			newest, newestTime = match, info.ModTime()
+		}
+	}
+	return newest
+}
+
+// key identifies the database and the settings it is opened with.
+func (db *database) key() string {
+	key := fmt.Sprintf("%s|%s|%s|%s|%v|%v|%v", db.path, db.dbType, db.mode, db.checksum, db.fields, db.parts, db.schedule)
+	if db.upd != nil {
+		key += fmt.Sprintf("|%s|%s|%s", db.upd.url, db.upd.accountID, db.upd.licenseKey)
+	}
+	return key
+}
+
+// version returns the version of the database in use, empty when none is open.
+func (db *database) version() *dbVersion {
+	if version, ok := db.current.Load().(*dbVersion); ok {
+		return version
+	}
+	return &dbVersion{}
+}
+
+// getLookup returns the lookup currently in use.
+func (db *database) getLookup() LookupGeoIP2 {
+	return db.version().lookup
+}
+
+// getMetadata returns the metadata of the database in use.
+func (db *database) getMetadata() dbMetadata {
+	return db.version().meta
+}
+
+// getState returns the state of the file the database in use has been opened from.
+func (db *database) getState() dbState {
+	return db.version().state
+}
+
+// setVersion swaps in the version and drops the results cached from the previous one.
+// Lookups in flight finish on the previous version.
+func (db *database) setVersion(version *dbVersion) {
+	db.current.Store(version)
+
+	db.mu.Lock()
+	caches := db.caches
+	db.mu.Unlock()
+
+	for _, c := range caches {
+		c.Flush()
+	}
+}
+
+// changed reports whether the file differs from the one the database in use has been opened from.
+func (db *database) changed() bool {
+	source := db.source()
+	info, err := os.Stat(source)
+	return err == nil && newDBState(source, info) != db.getState()
+}
+
+// addCache registers a cache of results from the database, it is flushed on reload.
+func (db *database) addCache(c *cache.Cache) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, registered := range db.caches {
+		if registered == c {
+			return
+		}
+	}
+	db.caches = append(db.caches, c)
+}
+
+// removeCache unregisters the cache c.
+func (db *database) removeCache(c *cache.Cache) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, registered := range db.caches {
+		if registered == c {
+			db.caches = append(db.caches[:i:i], db.caches[i+1:]...)
+			return
+		}
+	}
+}
+
+// startJob reports whether the background job name does not run for db yet, it is marked
+// running then. Instances sharing db thereby run each job once.
+func (db *database) startJob(name string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.jobs[name] {
+		return false
+	}
+	if db.jobs == nil {
+		db.jobs = map[string]bool{}
+	}
+	db.jobs[name] = true
+	return true
+}
+
+// stale reports whether the database in use was built longer than the maxAge of its
+// schedule ago.
+func (db *database) stale() bool {
+	maxAge := db.schedule.maxAge
+	buildTime := db.getMetadata().buildTime
+	return maxAge > 0 && !buildTime.IsZero() && time.Since(buildTime) > maxAge
+}
+
+// info describes the database in use for the debug header.
+func (db *database) info() string {
+	version := db.version()
+	if version.lookup == nil {
+		return db.path + "; not loaded"
+	}
+	meta := version.meta
+	info := version.path
+	if meta.databaseType != "" {
+		info += "; type=" + meta.databaseType
+	}
+	if !meta.buildTime.IsZero() {
+		info += "; built=" + meta.buildTime.UTC().Format(time.RFC3339)
+	}
+	if meta.nodeCount > 0 {
+		info += "; nodes=" + strconv.FormatUint(meta.nodeCount, 10)
+	}
+	return info
+}
+
+// checkAge warns when the database in use is stale.
+func (db *database) checkAge() {
+	if db.stale() {
+		logWarn.Printf("GeoIP DB `%s' is stale, built on %s", db.path, db.getMetadata().buildTime.UTC().Format("2006-01-02"))
+	}
+}
+
+// canonicalDBTypes maps each database type to the MaxMind database_type its reader accepts.
+var canonicalDBTypes = map[string]string{
+	DBTypeEnterprise:     "GeoIP2-Enterprise",
+	DBTypeCity:           "GeoIP2-City",
+	DBTypeCountry:        "GeoIP2-Country",
+	DBTypeASN:            "GeoLite2-ASN",
+	DBTypeAnonymousIP:    "GeoIP2-Anonymous-IP",
+	DBTypeISP:            "GeoIP2-ISP",
+	DBTypeConnectionType: "GeoIP2-Connection-Type",
+}
+
+// detectDBType guesses the database type from a file name or a database_type metadata value.
+func detectDBType(path string) string {
+	switch {
+	case strings.HasSuffix(strings.ToUpper(path), ".BIN"):
+		return DBTypeIP2Location
+	case strings.Contains(path, "Enterprise"):
+		return DBTypeEnterprise
+	case strings.Contains(path, "City"):
+		return DBTypeCity
+	case strings.Contains(path, "Country"):
+		return DBTypeCountry
+	case strings.Contains(path, "ASN"):
+		return DBTypeASN
+	case strings.Contains(path, "Anonymous"):
+		return DBTypeAnonymousIP
+	case strings.Contains(path, "ISP"):
+		return DBTypeISP
+	case strings.Contains(path, "Connection-Type"):
+		return DBTypeConnectionType
+	}
+	return ""
+}
+
+// openLookup loads the database file, verifies its checksum and creates the lookup for its type.
+// The type is detected from the file name or metadata when dbType is auto.
+func (db *database) openLookup(path string) (LookupGeoIP2, dbMetadata, error) {
+	if db.mode == DBModeMmap {
+		return db.openMappedLookup(path)
+	}
+
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, dbMetadata{}, fmt.Errorf("%w", err)
+	}
+	if err := verifyChecksum(path, buffer, db.checksum); err != nil {
+		return nil, dbMetadata{}, err
+	}
+	lookup, err := newLookup(path, buffer, db.dbType, db.fields, db.parts)
+	if err != nil {
+		return nil, dbMetadata{}, err
+	}
+	return lookup, newDBMetadata(buffer), nil
+}
+
+// openMappedLookup creates the lookup over the memory-mapped database file.
+// The mapping is released once the lookup is no longer referenced.
+func (db *database) openMappedLookup(path string) (LookupGeoIP2, dbMetadata, error) {
+	mapping, err := mapFile(path)
+	if err != nil {
+		return nil, dbMetadata{}, err
+	}
+	if err := verifyChecksum(path, mapping.data, db.checksum); err != nil {
+		return nil, dbMetadata{}, err
+	}
+	lookup, err := newLookup(path, mapping.data, db.dbType, db.fields, db.parts)
+	if err != nil {
+		return nil, dbMetadata{}, err
+	}
+	return func(ip net.IP) (*GeoIPResult, error) {
+		defer runtime.KeepAlive(mapping)
+		return lookup(ip)
+	}, newDBMetadata(mapping.data), nil
+}
+
+// newLookup creates the lookup for dbType over the database content in buffer.
+// Databases of other vendors in a MaxMind compatible layout, like DB-IP, are
+// detected from their metadata and opened with the matching reader. The record
+// paths in fields are looked up in any MaxMind DB, including custom ones, and
+// results of MaxMind DBs carry the network they matched. Only the parts of City and
+// Enterprise records are extracted.
+func newLookup(path string, buffer []byte, dbType string, fields map[string]string, parts recordParts) (LookupGeoIP2, error) {
+	metadata, _ := readMetadata(buffer)
+	databaseType, _ := metadata["database_type"].(string)
+
+	if dbType == "" || dbType == DBTypeAuto {
+		dbType = detectDBType(path)
+		if dbType == "" {
+			dbType = detectDBType(databaseType)
+		}
+		if dbType == "" && metadata != nil && len(fields) > 0 {
+			dbType = DBTypeCustom
+		}
+	}
+
+	var lookup LookupGeoIP2
+	if dbType != DBTypeCustom {
+		if canonical, ok := canonicalDBTypes[dbType]; ok && databaseType != "" && !isMaxMindType(databaseType) {
+			retyped, err := retypeDatabase(buffer, canonical)
+			if err != nil {
+				return nil, err
+			}
+			buffer = retyped
+		}
+		var err error
+		if lookup, err = newTypedLookup(path, buffer, dbType, parts); err != nil {
+			return nil, err
+		}
+	}
+
+	if metadata == nil {
+		if lookup == nil {
+			return nil, fmt.Errorf("`%s' is not a MaxMind DB with fields to look up", path)
+		}
+		return lookup, nil
+	}
+	rdr, err := newMMDBReader(buffer)
+	switch {
+	case err != nil && len(fields) > 0:
+		return nil, err
+	case err != nil:
+		return lookup, nil
+	}
+	switch dbType {
+	case DBTypeCity, DBTypeCountry, DBTypeEnterprise:
+		lookup = createRecordLookup(lookup, rdr, func(record interface{}) GeoIPResult {
+			return newRecordResult(record, parts)
+		})
+	case DBTypeISP:
+		lookup = createRecordLookup(lookup, rdr, newISPRecordResult)
+	}
+	if len(fields) > 0 {
+		lookup = createFieldsLookup(lookup, rdr, fields)
+	}
+	return createNetworkLookup(lookup, rdr), nil
+}
+
+// newTypedLookup creates the lookup of the reader for dbType extracting parts of the records.
+func newTypedLookup(path string, buffer []byte, dbType string, parts recordParts) (LookupGeoIP2, error) {
+	switch dbType {
+	case DBTypeEnterprise:
+		rdr, err := geoip2.NewEnterpriseReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return createEnterpriseDBLookup(rdr, parts), nil
+	case DBTypeCity:
+		rdr, err := geoip2.NewCityReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return createCityDBLookup(rdr, parts), nil
+	case DBTypeCountry:
+		rdr, err := geoip2.NewCountryReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return CreateCountryDBLookup(rdr), nil
+	case DBTypeASN:
+		rdr, err := geoip2.NewASNReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return CreateASNDBLookup(rdr), nil
+	case DBTypeAnonymousIP:
+		rdr, err := geoip2.NewAnonymousIPReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return CreateAnonymousIPDBLookup(rdr), nil
+	case DBTypeISP:
+		rdr, err := geoip2.NewISPReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return CreateISPDBLookup(rdr), nil
+	case DBTypeConnectionType:
+		rdr, err := geoip2.NewConnectionTypeReader(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		return CreateConnectionTypeDBLookup(rdr), nil
+	case DBTypeIP2Location:
+		rdr, err := NewIP2LocationReader(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return CreateIP2LocationDBLookup(rdr), nil
+	}
+	return nil, fmt.Errorf("unable to detect the type of `%s', set dbType", path)
+}
+
+// isMaxMindType reports whether databaseType is a database_type published by MaxMind.
+func isMaxMindType(databaseType string) bool {
+	return strings.HasPrefix(databaseType, "GeoIP2-") || strings.HasPrefix(databaseType, "GeoLite2-")
+}
+
+// validDBMode reports whether dbMode is a supported dbMode option.
+func validDBMode(dbMode string) bool {
+	switch dbMode {
+	case "", DBModeMemory, DBModeMmap:
+		return true
+	}
+	return false
+}
+
+// validDBType reports whether dbType is a supported dbType option.
+func validDBType(dbType string) bool {
+	switch dbType {
+	case "", DBTypeAuto, DBTypeCity, DBTypeCountry, DBTypeASN, DBTypeISP,
+		DBTypeAnonymousIP, DBTypeConnectionType, DBTypeEnterprise, DBTypeIP2Location, DBTypeCustom:
+		return true
+	}
+	return false
+}
+
+// verifyChecksum compares the SHA256 digest of content with expected. Without an expected
+// digest the sidecar file <path>.sha256 is used when it exists, in the sha256sum format.
+func verifyChecksum(path string, content []byte, expected string) error {
+	if expected == "" {
+		sidecar, err := ioutil.ReadFile(path + ".sha256")
+		if err != nil {
+			return nil
+		}
+		if fields := strings.Fields(string(sidecar)); len(fields) > 0 {
+			expected = fields[0]
+		}
+	}
+
+	sum := sha256.Sum256(content)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch of `%s': expected %s, got %s", path, expected, actual)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package traefikgeoip2
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// newNameEncoder returns the encoder of names in header values of the nameEncoding,
+// nil for raw UTF-8.
+func newNameEncoder(encoding string) func(string) string {
+	switch encoding {
+	case NameEncodingPercent:
+		return url.PathEscape
+	case NameEncodingASCII:
+		return transliterate
+	case NameEncodingRFC8187:
+		return encodeRFC8187
+	default:
+		return nil
+	}
+}
+
+// encoded returns v with its value sanitized, encoded by the nameEncoding and cut to the
+// maxValueLength.
+func (mw *TraefikGeoIP2) encoded(v geoValue) geoValue {
+	if v.value == "" {
+		return v
+	}
+	v.value = sanitize(v.value, 0)
+	if mw.encodeName != nil {
+		v.value = mw.encodeName(v.value)
+	}
+	v.value = truncate(v.value, mw.maxValueLength, mw.escapedNames)
+	return v
+}
+
+// sanitize returns value without invalid UTF-8 and control characters, like the CR and LF
+// that would end a header, cut to maxLength bytes at a character boundary unless 0.
+func sanitize(value string, maxLength int) string {
+	value = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value)
+	return truncate(value, maxLength, false)
+}
+
+// truncate cuts value to maxLength bytes unless 0, at a character boundary. When value is
+// percent-encoded, the cut is moved before an escape sequence it would split, and before
+// the escapes of the continuation bytes of a character.
+func truncate(value string, maxLength int, escaped bool) string {
+	if maxLength == 0 || len(value) <= maxLength {
+		return value
+	}
+	for maxLength > 0 && !utf8.RuneStart(value[maxLength]) {
+		maxLength--
+	}
+	if !escaped {
+		return value[:maxLength]
+	}
+	if i := strings.LastIndexByte(value[:maxLength], '%'); i >= 0 && i > maxLength-3 {
+		maxLength = i
+	}
+	for maxLength >= 3 && value[maxLength] == '%' && maxLength+1 < len(value) &&
+		strings.IndexByte("89AB", value[maxLength+1]) >= 0 && value[maxLength-3] == '%' {
+		maxLength -= 3
+	}
+	return value[:maxLength]
+}
+
+// sanitize removes invalid UTF-8 and control characters from the strings of r, as taken
+// from a database. Maps and slices are replaced rather than modified, since they may be
+// shared.
+func (r *GeoIPResult) sanitize() {
+	for _, value := range []*string{
+		&r.continent, &r.country, &r.registered, &r.represented, &r.region, &r.regionCode,
+		&r.region2, &r.region2Code, &r.city, &r.asOrg, &r.isp, &r.organization,
+		&r.connectionType, &r.userType, &r.mcc, &r.mnc, &r.network,
+	} {
+		*value = sanitize(*value, 0)
+	}
+	r.subdivisions = sanitizeSlice(r.subdivisions)
+	r.subdivisionCodes = sanitizeSlice(r.subdivisionCodes)
+	r.fields = sanitizeMap(r.fields)
+	if r.names != nil {
+		r.names = &placeNames{
+			country: sanitizeMap(r.names.country),
+			region:  sanitizeMap(r.names.region),
+			city:    sanitizeMap(r.names.city),
+		}
+	}
+}
+
+// sanitizeSlice returns values sanitized, values itself when none changes.
+func sanitizeSlice(values []string) []string {
+	for _, value := range values {
+		if sanitize(value, 0) != value {
+			sanitized := make([]string, len(values))
+			for i, value := range values {
+				sanitized[i] = sanitize(value, 0)
+			}
+			return sanitized
+		}
+	}
+	return values
+}
+
+// sanitizeMap returns values sanitized, values itself when none changes.
+func sanitizeMap(values map[string]string) map[string]string {
+	for _, value := range values {
+		if sanitize(value, 0) != value {
+			sanitized := make(map[string]string, len(values))
+			for key, value := range values {
+				sanitized[key] = sanitize(value, 0)
+			}
+			return sanitized
+		}
+	}
+	return values
+}
+
+// encodeRFC8187 encodes value as an RFC 8187 ext-value, e.g. `UTF-8”Z%C3%BCrich`.
+func encodeRFC8187(value string) string {
+	const hex = "0123456789ABCDEF"
+
+	var encoded strings.Builder
+	encoded.WriteString("UTF-8''")
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; isAttrChar(c) {
+			encoded.WriteByte(c)
+		} else {
+			encoded.WriteByte('%')
+			encoded.WriteByte(hex[c>>4])
+			encoded.WriteByte(hex[c&0xf])
+		}
+	}
+	return encoded.String()
+}
+
+// isAttrChar reports whether c is an attr-char of RFC 8187, which is not percent-encoded.
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+	}
+}
+
+// transliterate replaces the Latin letters with diacritics in value by their ASCII base
+// letters, e.g. `São Paulo` by `Sao Paulo`. Other non-ASCII characters are removed.
+func transliterate(value string) string {
+	var ascii strings.Builder
+	for _, r := range value {
+		switch {
+		case r < utf8.RuneSelf:
+			ascii.WriteRune(r)
+		case asciiLetters[r] != "":
+			ascii.WriteString(asciiLetters[r])
+		}
+	}
+	return strings.TrimSpace(ascii.String())
+}
+
+// asciiLetters are the ASCII forms of the letters of the Latin-1 Supplement and
+// Latin Extended-A blocks, which cover the place names of European and American countries.
+var asciiLetters = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y", 'Þ': "TH", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	'Ā': "A", 'ā': "a", 'Ă': "A", 'ă': "a", 'Ą': "A", 'ą': "a", 'Ć': "C", 'ć': "c",
+	'Ĉ': "C", 'ĉ': "c", 'Ċ': "C", 'ċ': "c", 'Č': "C", 'č': "c", 'Ď': "D", 'ď': "d",
+	'Đ': "D", 'đ': "d", 'Ē': "E", 'ē': "e", 'Ĕ': "E", 'ĕ': "e", 'Ė': "E", 'ė': "e",
+	'Ę': "E", 'ę': "e", 'Ě': "E", 'ě': "e", 'Ĝ': "G", 'ĝ': "g", 'Ğ': "G", 'ğ': "g",
+	'Ġ': "G", 'ġ': "g", 'Ģ': "G", 'ģ': "g", 'Ĥ': "H", 'ĥ': "h", 'Ħ': "H", 'ħ': "h",
+	'Ĩ': "I", 'ĩ': "i", 'Ī': "I", 'ī': "i", 'Ĭ': "I", 'ĭ': "i", 'Į': "I", 'į': "i",
+	'İ': "I", 'ı': "i", 'Ĳ': "IJ", 'ĳ': "ij", 'Ĵ': "J", 'ĵ': "j", 'Ķ': "K", 'ķ': "k",
+	'ĸ': "k", 'Ĺ': "L", 'ĺ': "l", 'Ļ': "L", 'ļ': "l", 'Ľ': "L", 'ľ': "l", 'Ŀ': "L",
+	'ŀ': "l", 'Ł': "L", 'ł': "l", 'Ń': "N", 'ń': "n", 'Ņ': "N", 'ņ': "n", 'Ň': "N",
+	'ň': "n", 'ŉ': "n", 'Ŋ': "N", 'ŋ': "n", 'Ō': "O", 'ō': "o", 'Ŏ': "O", 'ŏ': "o",
+	'Ő': "O", 'ő': "o", 'Œ': "OE", 'œ': "oe", 'Ŕ': "R", 'ŕ': "r", 'Ŗ': "R", 'ŗ': "r",
+	'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Ŝ': "S", 'ŝ': "s", 'Ş': "S", 'ş': "s",
+	'Š': "S", 'š': "s", 'Ţ': "T", 'ţ': "t", 'Ť': "T", 'ť': "t", 'Ŧ': "T", 'ŧ': "t",
+	'Ũ': "U", 'ũ': "u", 'Ū': "U", 'ū': "u", 'Ŭ': "U", 'ŭ': "u", 'Ů': "U", 'ů': "u",
+	'Ű': "U", 'ű': "u", 'Ų': "U", 'ų': "u", 'Ŵ': "W", 'ŵ': "w", 'Ŷ': "Y", 'ŷ': "y",
+	'Ÿ': "Y", 'Ź': "Z", 'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z", 'ſ': "s",
+	'Ș': "S", 'ș': "s", 'Ț': "T", 'ț': "t",
+}
@@ -0,0 +1,60 @@
+package traefikgeoip2
+
+import (
+	"errors"
+	"net"
+)
+
+// builtinCountries is a tiny last-resort dataset of large legacy IPv4 allocations
+// that have been held by the same national organization for decades.
+var builtinCountries = map[string]string{
+	"3.0.0.0/8":   "US",
+	"6.0.0.0/8":   "US",
+	"7.0.0.0/8":   "US",
+	"11.0.0.0/8":  "US",
+	"12.0.0.0/8":  "US",
+	"17.0.0.0/8":  "US",
+	"19.0.0.0/8":  "US",
+	"21.0.0.0/8":  "US",
+	"22.0.0.0/8":  "US",
+	"25.0.0.0/8":  "GB",
+	"26.0.0.0/8":  "US",
+	"28.0.0.0/8":  "US",
+	"29.0.0.0/8":  "US",
+	"30.0.0.0/8":  "US",
+	"33.0.0.0/8":  "US",
+	"53.0.0.0/8":  "DE",
+	"55.0.0.0/8":  "US",
+	"56.0.0.0/8":  "US",
+	"133.0.0.0/8": "JP",
+	"214.0.0.0/8": "US",
+	"215.0.0.0/8": "US",
+}
+
+// errNotInFallback is returned for addresses the built-in dataset does not cover.
+var errNotInFallback = errors.New("not found in built-in dataset")
+
+// CreateBuiltinLookup creates a country lookup over the built-in dataset.
+func CreateBuiltinLookup() LookupGeoIP2 {
+	networks := make(map[*net.IPNet]string, len(builtinCountries))
+	for cidr, country := range builtinCountries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		networks[network] = country
+	}
+
+	return func(ip net.IP) (*GeoIPResult, error) {
+		for network, country := range networks {
+			if network.Contains(ip) {
+				return &GeoIPResult{
+					country: country,
+					region:  Unknown,
+					city:    Unknown,
+				}, nil
+			}
+		}
+		return nil, errNotInFallback
+	}
+}
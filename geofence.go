@@ -0,0 +1,69 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Geofence a circle around a coordinate clients are allowed or blocked within.
+type Geofence struct {
+	Center   string  `json:"center,omitempty"`
+	RadiusKm float64 `json:"radiusKm,omitempty"`
+	Action   string  `json:"action,omitempty"`
+}
+
+// geofence a Geofence with its parsed center.
+type geofence struct {
+	name   string
+	center coordinate
+	radius float64
+	block  bool
+}
+
+// newGeofences parses the geofences, the allow action is the default.
+func newGeofences(fences []Geofence) ([]geofence, error) {
+	geofences := make([]geofence, 0, len(fences))
+	for _, fence := range fences {
+		center, err := parseCoordinate("geofences center", fence.Center)
+		if err != nil {
+			return nil, err
+		}
+		if fence.RadiusKm <= 0 {
+			return nil, fmt.Errorf("invalid geofences radiusKm %v", fence.RadiusKm)
+		}
+		parsed := geofence{center: *center, radius: fence.RadiusKm}
+		switch fence.Action {
+		case "", GeofenceAllow:
+		case GeofenceBlock:
+			parsed.block = true
+		default:
+			return nil, fmt.Errorf("unsupported geofences action `%s'", fence.Action)
+		}
+		parsed.name = strconv.FormatFloat(fence.RadiusKm, 'f', -1, 64) + " km of " + fence.Center
+		geofences = append(geofences, parsed)
+	}
+	return geofences, nil
+}
+
+// geofenceBlocks returns the geofence the client at location is blocked by: a block
+// geofence it is within, or any allow geofence when it is within none of them. Clients
+// without coordinates are only blocked by allow geofences. It returns "" when the client
+// is not blocked.
+func (r *accessRules) geofenceBlocks(location *coordinate) string {
+	var allowed, outside string
+	for _, fence := range r.geofences {
+		within := location != nil && fence.center.distance(*location) <= fence.radius
+		switch {
+		case fence.block && within:
+			return fence.name
+		case !fence.block && within:
+			allowed = fence.name
+		case !fence.block && outside == "":
+			outside = fence.name
+		}
+	}
+	if allowed != "" {
+		return ""
+	}
+	return outside
+}
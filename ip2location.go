@@ -0,0 +1,144 @@
+package traefikgeoip2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Columns of the IP2Location fields per database type DB1 to DB26, 0 when the type lacks the field.
+var (
+	ip2locationCountry = [27]uint32{0, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+	ip2locationRegion  = [27]uint32{0, 0, 0, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
+	ip2locationCity    = [27]uint32{0, 0, 0, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4}
+	ip2locationISP     = [27]uint32{0, 0, 3, 0, 5, 0, 7, 5, 7, 0, 8, 0, 9, 0, 9, 0, 9, 0, 9, 7, 9, 0, 9, 7, 9, 9, 9}
+)
+
+var (
+	errIP2LocationInvalid = errors.New("invalid IP2Location BIN data")
+	errNotInIP2Location   = errors.New("not found in IP2Location database")
+)
+
+// IP2LocationReader reads IP2Location BIN databases.
+type IP2LocationReader struct {
+	buffer    []byte
+	dbType    uint32
+	columns   uint32
+	ipv4Count uint32
+	ipv4Base  uint32
+	ipv6Count uint32
+	ipv6Base  uint32
+}
+
+// NewIP2LocationReader creates a reader over the content of an IP2Location BIN file.
+func NewIP2LocationReader(buffer []byte) (*IP2LocationReader, error) {
+	if len(buffer) < 29 {
+		return nil, errIP2LocationInvalid
+	}
+	rdr := &IP2LocationReader{
+		buffer:    buffer,
+		dbType:    uint32(buffer[0]),
+		columns:   uint32(buffer[1]),
+		ipv4Count: binary.LittleEndian.Uint32(buffer[5:]),
+		ipv4Base:  binary.LittleEndian.Uint32(buffer[9:]),
+		ipv6Count: binary.LittleEndian.Uint32(buffer[13:]),
+		ipv6Base:  binary.LittleEndian.Uint32(buffer[17:]),
+	}
+	if rdr.dbType == 0 || rdr.dbType >= uint32(len(ip2locationCountry)) || rdr.columns < 2 {
+		return nil, fmt.Errorf("unsupported IP2Location database type %d", rdr.dbType)
+	}
+	return rdr, nil
+}
+
+// row finds the row of the range containing ip and returns it with the size of its address column.
+func (rdr *IP2LocationReader) row(ip net.IP) ([]byte, int, error) {
+	key, count, base := []byte(ip.To4()), rdr.ipv4Count, rdr.ipv4Base
+	if key == nil {
+		key, count, base = []byte(ip.To16()), rdr.ipv6Count, rdr.ipv6Base
+	}
+	if key == nil || count == 0 || base == 0 {
+		return nil, 0, errNotInIP2Location
+	}
+
+	size := len(key) + int(rdr.columns-1)*4
+	rowAt := func(i uint32) []byte {
+		start := int(base-1) + int(i)*size
+		if start+size > len(rdr.buffer) {
+			return nil
+		}
+		return rdr.buffer[start : start+size]
+	}
+
+	low, high := 0, int(count)-1
+	for low <= high {
+		mid := (low + high) / 2
+		row, next := rowAt(uint32(mid)), rowAt(uint32(mid+1))
+		if row == nil || next == nil {
+			return nil, 0, errNotInIP2Location
+		}
+		switch {
+		case bytes.Compare(key, ip2locationAddr(row, len(key))) < 0:
+			high = mid - 1
+		case bytes.Compare(key, ip2locationAddr(next, len(key))) >= 0:
+			low = mid + 1
+		default:
+			return row, len(key), nil
+		}
+	}
+	return nil, 0, errNotInIP2Location
+}
+
+// field returns the string the column in row points to, empty when the database type lacks it.
+func (rdr *IP2LocationReader) field(row []byte, addrSize int, columns [27]uint32) string {
+	column := columns[rdr.dbType]
+	if column == 0 || column > rdr.columns {
+		return ""
+	}
+	offset := addrSize + int(column-2)*4
+	pointer := int(binary.LittleEndian.Uint32(row[offset:]))
+	if pointer >= len(rdr.buffer) || pointer+1+int(rdr.buffer[pointer]) > len(rdr.buffer) {
+		return ""
+	}
+	value := string(rdr.buffer[pointer+1 : pointer+1+int(rdr.buffer[pointer])])
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// ip2locationAddr returns the address a row starts with in network byte order.
+func ip2locationAddr(row []byte, size int) []byte {
+	addr := make([]byte, size)
+	for i := 0; i < size; i++ {
+		addr[i] = row[size-1-i]
+	}
+	return addr
+}
+
+// CreateIP2LocationDBLookup CreateIP2LocationDBLookup.
+func CreateIP2LocationDBLookup(rdr *IP2LocationReader) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		row, addrSize, err := rdr.row(ip)
+		if err != nil {
+			return nil, err
+		}
+		retval := GeoIPResult{
+			country: rdr.field(row, addrSize, ip2locationCountry),
+			region:  rdr.field(row, addrSize, ip2locationRegion),
+			city:    rdr.field(row, addrSize, ip2locationCity),
+			isp:     rdr.field(row, addrSize, ip2locationISP),
+		}
+		if retval.country == "" {
+			return nil, errNotInIP2Location
+		}
+		if retval.region == "" {
+			retval.region = Unknown
+		}
+		if retval.city == "" {
+			retval.city = Unknown
+		}
+		return &retval, nil
+	}
+}
@@ -0,0 +1,51 @@
+package traefikgeoip2
+
+import (
+	"net/http"
+	"strings"
+)
+
+// newLanguages returns the language tags by country of languageHint, the countryLanguages
+// with the overrides of languages, a language of `*` is used for other countries.
+func newLanguages(languages map[string]string) countryMap {
+	values := make(map[string]string, len(countryLanguages)+len(languages))
+	for country, language := range countryLanguages {
+		values[country] = language + "-" + country
+	}
+	for country, language := range languages {
+		values[strings.ToUpper(country)] = language
+	}
+	return countryMap{header: SuggestedLanguageHeader, values: values}
+}
+
+// setAcceptLanguage sets the Accept-Language of req to the language of country when the
+// client sent none.
+func (mw *TraefikGeoIP2) setAcceptLanguage(req *http.Request, country string) {
+	if req.Header.Get(AcceptLanguageHeader) != "" {
+		return
+	}
+	if language := mw.languages.value(country); language != "" {
+		req.Header.Set(AcceptLanguageHeader, language)
+	}
+}
+
+// countryLanguages the ISO 639-1 code of the most spoken official language by country.
+var countryLanguages = map[string]string{
+	"AD": "ca", "AE": "ar", "AF": "fa", "AL": "sq", "AM": "hy", "AO": "pt", "AR": "es", "AT": "de",
+	"AU": "en", "AZ": "az", "BA": "bs", "BD": "bn", "BE": "nl", "BG": "bg", "BH": "ar", "BO": "es",
+	"BR": "pt", "BY": "be", "CA": "en", "CD": "fr", "CH": "de", "CI": "fr", "CL": "es", "CM": "fr",
+	"CN": "zh", "CO": "es", "CR": "es", "CU": "es", "CY": "el", "CZ": "cs", "DE": "de", "DK": "da",
+	"DO": "es", "DZ": "ar", "EC": "es", "EE": "et", "EG": "ar", "ES": "es", "ET": "am", "FI": "fi",
+	"FR": "fr", "GB": "en", "GE": "ka", "GH": "en", "GR": "el", "GT": "es", "HK": "zh", "HN": "es",
+	"HR": "hr", "HU": "hu", "ID": "id", "IE": "en", "IL": "he", "IN": "hi", "IQ": "ar", "IR": "fa",
+	"IS": "is", "IT": "it", "JM": "en", "JO": "ar", "JP": "ja", "KE": "sw", "KG": "ky", "KH": "km",
+	"KR": "ko", "KW": "ar", "KZ": "kk", "LA": "lo", "LB": "ar", "LI": "de", "LK": "si", "LT": "lt",
+	"LU": "lb", "LV": "lv", "LY": "ar", "MA": "ar", "MC": "fr", "MD": "ro", "ME": "sr", "MK": "mk",
+	"MM": "my", "MN": "mn", "MO": "zh", "MT": "mt", "MX": "es", "MY": "ms", "NG": "en", "NI": "es",
+	"NL": "nl", "NO": "nb", "NP": "ne", "NZ": "en", "OM": "ar", "PA": "es", "PE": "es", "PH": "fil",
+	"PK": "ur", "PL": "pl", "PR": "es", "PT": "pt", "PY": "es", "QA": "ar", "RO": "ro", "RS": "sr",
+	"RU": "ru", "SA": "ar", "SE": "sv", "SG": "en", "SI": "sl", "SK": "sk", "SM": "it", "SN": "fr",
+	"SV": "es", "SY": "ar", "TH": "th", "TJ": "tg", "TM": "tk", "TN": "ar", "TR": "tr", "TW": "zh",
+	"TZ": "sw", "UA": "uk", "UG": "en", "US": "en", "UY": "es", "UZ": "uz", "VA": "it", "VE": "es",
+	"VN": "vi", "YE": "ar", "ZA": "en", "ZW": "en",
+}
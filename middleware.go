@@ -3,11 +3,15 @@ package traefikgeoip2
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,24 +27,217 @@ var (
 
 // Config the plugin configuration.
 type Config struct {
-	DBPath   string `json:"dbPath,omitempty"`
-	LogLevel string `yaml:"loglevel"`
+	DBPath               string                       `json:"dbPath,omitempty"`
+	DBPaths              []string                     `json:"dbPaths,omitempty"`
+	DBType               string                       `json:"dbType,omitempty"`
+	DBChecksum           string                       `json:"dbChecksum,omitempty"`
+	DBMode               string                       `json:"dbMode,omitempty"`
+	FailOnError          bool                         `json:"failOnError,omitempty"`
+	RetryInterval        string                       `json:"retryInterval,omitempty"`
+	LazyOpen             bool                         `json:"lazyOpen,omitempty"`
+	OverrideDBPath       string                       `json:"overrideDbPath,omitempty"`
+	Overrides            []Override                   `json:"overrides,omitempty"`
+	BuiltinFallback      bool                         `json:"builtinFallback,omitempty"`
+	Fields               map[string]string            `json:"fields,omitempty"`
+	CustomHeaders        map[string]string            `json:"customHeaders,omitempty"`
+	CountryMaps          map[string]map[string]string `json:"countryMaps,omitempty"`
+	LanguageHint         string                       `json:"languageHint,omitempty"`
+	Languages            map[string]string            `json:"languages,omitempty"`
+	CallingCode          bool                         `json:"callingCode,omitempty"`
+	SignatureSecret      string                       `json:"signatureSecret,omitempty"`
+	MaxValueLength       int                          `json:"maxValueLength,omitempty"`
+	OutputFields         []string                     `json:"outputFields,omitempty"`
+	EnabledFields        map[string]bool              `json:"enabledFields,omitempty"`
+	Headers              HeaderNames                  `json:"headers,omitempty"`
+	HeaderPrefix         string                       `json:"headerPrefix,omitempty"`
+	OutputMode           string                       `json:"outputMode,omitempty"`
+	NameEncoding         string                       `json:"nameEncoding,omitempty"`
+	SetResponseHeaders   bool                         `json:"setResponseHeaders,omitempty"`
+	Cookie               GeoCookie                    `json:"cookie,omitempty"`
+	QueryParams          map[string]string            `json:"queryParams,omitempty"`
+	CoordinatePrecision  int                          `json:"coordinatePrecision,omitempty"`
+	GeoHashPrecision     int                          `json:"geoHashPrecision,omitempty"`
+	DistanceFrom         string                       `json:"distanceFrom,omitempty"`
+	RegionFormat         string                       `json:"regionFormat,omitempty"`
+	SubdivisionSeparator string                       `json:"subdivisionSeparator,omitempty"`
+	CountryFormat        string                       `json:"countryFormat,omitempty"`
+	CountryCase          string                       `json:"countryCase,omitempty"`
+	Locales              []string                     `json:"locales,omitempty"`
+	UnknownBehaviour     string                       `json:"unknownBehaviour,omitempty"`
+	Placeholder          string                       `json:"placeholder"`
+	MaxDBAge             string                       `json:"maxDbAge,omitempty"`
+	DebugHeader          bool                         `json:"debugHeader,omitempty"`
+	DebugOverrideHeader  string                       `json:"debugOverrideHeader,omitempty"`
+	DebugOverrideQuery   string                       `json:"debugOverrideQuery,omitempty"`
+	DebugOverrideSecret  string                       `json:"debugOverrideSecret,omitempty"`
+	IPHeader             string                       `json:"ipHeader,omitempty"`
+	IPHeaders            []string                     `json:"ipHeaders,omitempty"`
+	IPStrategy           string                       `json:"ipStrategy,omitempty"`
+	PreferRemoteAddr     bool                         `json:"preferRemoteAddr,omitempty"`
+	TrustedProxies       []string                     `json:"trustedProxies,omitempty"`
+	SpoofPolicy          string                       `json:"spoofPolicy,omitempty"`
+	PeerLookup           bool                         `json:"peerLookup,omitempty"`
+	SkipPrivate          bool                         `json:"skipPrivate,omitempty"`
+	BypassCIDRs          []string                     `json:"bypassCidrs,omitempty"`
+	RulesScope           []RequestMatch               `json:"rulesScope,omitempty"`
+	RulesExceptions      []RequestMatch               `json:"rulesExceptions,omitempty"`
+	CountryRateLimits    map[string]RateLimit         `json:"countryRateLimits,omitempty"`
+	AllowedCountries     []string                     `json:"allowedCountries,omitempty"`
+	BlockedCountries     []string                     `json:"blockedCountries,omitempty"`
+	AllowedContinents    []string                     `json:"allowedContinents,omitempty"`
+	BlockedContinents    []string                     `json:"blockedContinents,omitempty"`
+	AllowedRegions       []string                     `json:"allowedRegions,omitempty"`
+	BlockedRegions       []string                     `json:"blockedRegions,omitempty"`
+	AllowedCities        []string                     `json:"allowedCities,omitempty"`
+	BlockedCities        []string                     `json:"blockedCities,omitempty"`
+	AllowedASNs          []string                     `json:"allowedAsns,omitempty"`
+	BlockedASNs          []string                     `json:"blockedAsns,omitempty"`
+	BlockedASOrgs        []string                     `json:"blockedAsOrgs,omitempty"`
+	BlockAnonymizers     []string                     `json:"blockAnonymizers,omitempty"`
+	Geofences            []Geofence                   `json:"geofences,omitempty"`
+	GeoZonesPath         string                       `json:"geoZonesPath,omitempty"`
+	GeoZonesAction       string                       `json:"geoZonesAction,omitempty"`
+	BlockStatus          int                          `json:"blockStatus,omitempty"`
+	BlockBody            string                       `json:"blockBody,omitempty"`
+	BlockTemplate        string                       `json:"blockTemplate,omitempty"`
+	BlockContentType     string                       `json:"blockContentType,omitempty"`
+	BlockedBy            string                       `json:"blockedBy,omitempty"`
+	BlockAction          string                       `json:"blockAction,omitempty"`
+	BlockRedirectURL     string                       `json:"blockRedirectUrl,omitempty"`
+	OnLookupError        string                       `json:"onLookupError,omitempty"`
+	InvalidAddrPolicy    string                       `json:"invalidAddrPolicy,omitempty"`
+	InvalidAddrIP        string                       `json:"invalidAddrIp,omitempty"`
+	ForwardedForDepth    int                          `json:"forwardedForDepth,omitempty"`
+	SelectStrategy       string                       `json:"selectStrategy,omitempty"`
+	SharedCache          bool                         `json:"sharedCache,omitempty"`
+	ReloadPath           string                       `json:"reloadPath,omitempty"`
+	ReloadSecret         string                       `json:"reloadSecret,omitempty"`
+	LogLevel             string                       `yaml:"loglevel"`
+	WatchInterval        string                       `json:"watchInterval,omitempty"`
+	ReloadInterval       string                       `json:"reloadInterval,omitempty"`
+	AccountID            string                       `json:"accountId,omitempty"`
+	LicenseKey           string                       `json:"licenseKey,omitempty"`
+	EditionID            string                       `json:"editionId,omitempty"`
+	DownloadDir          string                       `json:"downloadDir,omitempty"`
+	DownloadURL          string                       `json:"downloadUrl,omitempty"`
+	UpdateInterval       string                       `json:"updateInterval,omitempty"`
+	UpdateJitter         string                       `json:"updateJitter,omitempty"`
+	UpdateProtocol       string                       `json:"updateProtocol,omitempty"`
+	UpdateURL            string                       `json:"updateUrl,omitempty"`
+	S3Region             string                       `json:"s3Region,omitempty"`
+	S3Endpoint           string                       `json:"s3Endpoint,omitempty"`
+	S3AccessKeyID        string                       `json:"s3AccessKeyId,omitempty"`
+	S3SecretAccessKey    string                       `json:"s3SecretAccessKey,omitempty"`
+	S3SessionToken       string                       `json:"s3SessionToken,omitempty"`
+	GCSAccessToken       string                       `json:"gcsAccessToken,omitempty"`
+	AzureSASToken        string                       `json:"azureSasToken,omitempty"`
+}
+
+// HeaderNames names of the country, region and city headers.
+type HeaderNames struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	City    string `json:"city,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		LogLevel: DefaultLogLevel,
-		DBPath:   DefaultDBPath,
+		LogLevel:             DefaultLogLevel,
+		DBPath:               DefaultDBPath,
+		DBType:               DBTypeAuto,
+		DBMode:               DBModeMemory,
+		CoordinatePrecision:  DefaultCoordinatePrecision,
+		MaxValueLength:       DefaultMaxValueLength,
+		RegionFormat:         RegionFormatName,
+		SubdivisionSeparator: DefaultSubdivisionSeparator,
+		Locales:              []string{DefaultLocale},
+		UnknownBehaviour:     UnknownPlaceholder,
+		Placeholder:          Unknown,
+		Headers: HeaderNames{
+			Country: CountryHeader,
+			Region:  RegionHeader,
+			City:    CityHeader,
+		},
+		IPHeader:          RealIPHeader,
+		SelectStrategy:    SelectDepth,
+		InvalidAddrPolicy: InvalidAddrUnknown,
+		SpoofPolicy:       SpoofIgnore,
+		EditionID:         DefaultEditionID,
+		DownloadURL:       DefaultDownloadURL,
+		UpdateInterval:    DefaultUpdateInterval,
+		UpdateProtocol:    UpdateProtocolDownload,
+		UpdateURL:         DefaultUpdateURL,
+		RetryInterval:     DefaultRetryInterval,
+		BlockStatus:       http.StatusForbidden,
+		OnLookupError:     LookupErrorAllow,
 	}
 }
 
 // TraefikGeoIP2 a traefik geoip2 plugin.
 type TraefikGeoIP2 struct {
-	next   http.Handler
-	lookup LookupGeoIP2
-	name   string
-	cache  *cache.Cache
+	next                 http.Handler
+	databases            []*database
+	override             *database
+	static               LookupGeoIP2
+	fallback             LookupGeoIP2
+	fields               []string
+	customHeaders        []customHeader
+	countryMaps          []countryMap
+	languageHint         string
+	languages            countryMap
+	callingCode          bool
+	signatureSecret      []byte
+	maxValueLength       int
+	selected             map[string]bool
+	headers              HeaderNames
+	prefix               string
+	output               string
+	encodeName           func(string) string
+	escapedNames         bool
+	responseHeaders      bool
+	cookie               *geoCookie
+	queryParams          []queryParam
+	precision            int
+	geoHashPrecision     int
+	distanceFrom         *coordinate
+	regionCodes          bool
+	subdivisionSeparator string
+	countryAlpha3        bool
+	countryCase          string
+	locales              []string
+	omitUnknown          bool
+	placeholder          string
+	lazyOpen             bool
+	retryEvery           time.Duration
+	debug                bool
+	debugIP              debugOverride
+	reloadPath           string
+	reloadSecret         string
+	reloads              *reloadGate
+	ipHeaders            []string
+	skipPrivateHeaders   bool
+	remoteOnly           bool
+	trusted              []*net.IPNet
+	spoofPolicy          string
+	peerLookup           bool
+	cdns                 []cdnPreset
+	private              bool
+	rules                *accessRules
+	failOpen             bool
+	bypass               []*net.IPNet
+	ruleScope            []requestMatch
+	ruleExceptions       []requestMatch
+	limiter              *rateLimiter
+	zones                []geoZone
+	blocked              blockResponse
+	invalidAddr          string
+	fallbackIP           net.IP
+	xffDepth             int
+	xffStrategy          string
+	name                 string
+	cache                *cache.Cache
+	cacheKey             string
 }
 
 // New created a new TraefikGeoIP2 plugin.
@@ -58,110 +255,643 @@ func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http
 	}
 	logErr.SetOutput(os.Stderr)
 
-	if _, err := os.Stat(cfg.DBPath); err != nil {
-		logErr.Printf("GeoIP DB `%s' not found: %v", cfg.DBPath, err)
-		return &TraefikGeoIP2{
-			lookup: nil,
-			next:   next,
-			name:   name,
-			cache:  nil,
-		}, nil
+	mw := &TraefikGeoIP2{
+		next:  next,
+		debug: cfg.DebugHeader,
+		debugIP: debugOverride{
+			header: cfg.DebugOverrideHeader,
+			query:  cfg.DebugOverrideQuery,
+			secret: cfg.DebugOverrideSecret,
+		},
+		reloadPath:   cfg.ReloadPath,
+		reloadSecret: cfg.ReloadSecret,
+		reloads:      &reloadGate{},
+		ipHeaders:    cfg.IPHeaders,
+		remoteOnly:   cfg.PreferRemoteAddr,
+		private:      cfg.SkipPrivate,
+		spoofPolicy:  cfg.SpoofPolicy,
+		peerLookup:   cfg.PeerLookup,
+		invalidAddr:  cfg.InvalidAddrPolicy,
+		xffDepth:     cfg.ForwardedForDepth,
+		xffStrategy:  cfg.SelectStrategy,
+		name:         name,
 	}
-
-	var lookup LookupGeoIP2
-	if strings.Contains(cfg.DBPath, "City") {
-		rdr, err := geoip2.NewCityReaderFromFile(cfg.DBPath)
+	if cfg.CoordinatePrecision < 0 {
+		return nil, fmt.Errorf("invalid coordinatePrecision %d", cfg.CoordinatePrecision)
+	}
+	mw.precision = cfg.CoordinatePrecision
+	if cfg.GeoHashPrecision < 0 || cfg.GeoHashPrecision > MaxGeoHashPrecision {
+		return nil, fmt.Errorf("invalid geoHashPrecision %d", cfg.GeoHashPrecision)
+	}
+	mw.geoHashPrecision = cfg.GeoHashPrecision
+	if cfg.MaxValueLength < 0 {
+		return nil, fmt.Errorf("invalid maxValueLength %d", cfg.MaxValueLength)
+	}
+	mw.maxValueLength = cfg.MaxValueLength
+	if cfg.DistanceFrom != "" {
+		from, err := parseCoordinate("distanceFrom", cfg.DistanceFrom)
 		if err != nil {
-			logWarn.Printf("GeoIP DB `%s' not initialized: %v", cfg.DBPath, err)
-		} else {
-			lookup = CreateCityDBLookup(rdr)
+			return nil, err
+		}
+		mw.distanceFrom = from
+	}
+	mw.locales = cfg.Locales
+	if len(mw.locales) == 0 {
+		mw.locales = []string{DefaultLocale}
+	}
+	mw.placeholder = cfg.Placeholder
+	switch cfg.UnknownBehaviour {
+	case "", UnknownPlaceholder:
+	case UnknownOmit:
+		mw.omitUnknown = true
+	default:
+		return nil, fmt.Errorf("unsupported unknownBehaviour `%s'", cfg.UnknownBehaviour)
+	}
+	switch cfg.RegionFormat {
+	case "", RegionFormatName:
+	case RegionFormatCode:
+		mw.regionCodes = true
+	default:
+		return nil, fmt.Errorf("unsupported regionFormat `%s'", cfg.RegionFormat)
+	}
+	mw.subdivisionSeparator = firstNonEmpty(cfg.SubdivisionSeparator, DefaultSubdivisionSeparator)
+	switch cfg.CountryFormat {
+	case "", CountryFormatAlpha2:
+	case CountryFormatAlpha3:
+		mw.countryAlpha3 = true
+	default:
+		return nil, fmt.Errorf("unsupported countryFormat `%s'", cfg.CountryFormat)
+	}
+	switch cfg.CountryCase {
+	case "", CaseUpper, CaseLower:
+		mw.countryCase = cfg.CountryCase
+	default:
+		return nil, fmt.Errorf("unsupported countryCase `%s'", cfg.CountryCase)
+	}
+	mw.prefix = cfg.HeaderPrefix
+	switch cfg.OutputMode {
+	case "", OutputHeaders, OutputJSON, OutputBoth:
+		mw.output = cfg.OutputMode
+	default:
+		return nil, fmt.Errorf("unsupported outputMode `%s'", cfg.OutputMode)
+	}
+	mw.responseHeaders = cfg.SetResponseHeaders
+	switch cfg.NameEncoding {
+	case "", NameEncodingUTF8, NameEncodingPercent, NameEncodingASCII, NameEncodingRFC8187:
+		mw.encodeName = newNameEncoder(cfg.NameEncoding)
+		mw.escapedNames = cfg.NameEncoding == NameEncodingPercent || cfg.NameEncoding == NameEncodingRFC8187
+	default:
+		return nil, fmt.Errorf("unsupported nameEncoding `%s'", cfg.NameEncoding)
+	}
+	mw.headers = HeaderNames{
+		Country: mw.header(firstNonEmpty(cfg.Headers.Country, CountryHeader)),
+		Region:  mw.header(firstNonEmpty(cfg.Headers.Region, RegionHeader)),
+		City:    mw.header(firstNonEmpty(cfg.Headers.City, CityHeader)),
+	}
+	mw.skipPrivateHeaders = len(mw.ipHeaders) > 0
+	if len(mw.ipHeaders) == 0 {
+		mw.ipHeaders = []string{cfg.IPHeader}
+		if cfg.IPHeader == "" {
+			mw.ipHeaders = []string{RealIPHeader}
 		}
 	}
+	if cfg.BuiltinFallback {
+		mw.fallback = CreateBuiltinLookup()
+	}
 
-	if strings.Contains(cfg.DBPath, "Country") {
-		rdr, err := geoip2.NewCountryReaderFromFile(cfg.DBPath)
-		if err != nil {
-			logWarn.Printf("GeoIP DB `%s' not initialized: %v", cfg.DBPath, err)
-		} else {
-			lookup = CreateCountryDBLookup(rdr)
+	if !validDBType(cfg.DBType) {
+		return nil, fmt.Errorf("invalid dbType `%s'", cfg.DBType)
+	}
+	if !validDBMode(cfg.DBMode) {
+		return nil, fmt.Errorf("unsupported dbMode `%s'", cfg.DBMode)
+	}
+	if cfg.DBMode == DBModeMmap && !mmapSupported {
+		return nil, fmt.Errorf("dbMode `%s' needs a native build with the geoip2mmap tag, Traefik plugins cannot map files", cfg.DBMode)
+	}
+	trusted, err := parseCIDRs("trustedProxies", cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	mw.trusted = trusted
+	if mw.cdns, err = newCDNPresets(cfg.IPStrategy, trusted); err != nil {
+		return nil, err
+	}
+	if mw.static, err = newStaticLookup(cfg.Overrides); err != nil {
+		return nil, err
+	}
+	if cfg.ReloadPath != "" && cfg.ReloadSecret == "" {
+		return nil, fmt.Errorf("reloadPath needs reloadSecret")
+	}
+	if (cfg.DebugOverrideHeader != "" || cfg.DebugOverrideQuery != "") && cfg.DebugOverrideSecret == "" {
+		return nil, fmt.Errorf("debugOverrideHeader and debugOverrideQuery need debugOverrideSecret")
+	}
+	switch cfg.SpoofPolicy {
+	case "", SpoofIgnore, SpoofFlag:
+	default:
+		return nil, fmt.Errorf("unsupported spoofPolicy `%s'", cfg.SpoofPolicy)
+	}
+	switch cfg.InvalidAddrPolicy {
+	case "", InvalidAddrUnknown, InvalidAddrSkip, InvalidAddrPrivate:
+	case InvalidAddrFallback:
+		if mw.fallbackIP = parseAddr(cfg.InvalidAddrIP); mw.fallbackIP == nil {
+			return nil, fmt.Errorf("invalid invalidAddrIp `%s'", cfg.InvalidAddrIP)
 		}
+	default:
+		return nil, fmt.Errorf("unsupported invalidAddrPolicy `%s'", cfg.InvalidAddrPolicy)
+	}
+	switch cfg.SelectStrategy {
+	case "", SelectDepth, SelectFirstPublic, SelectLast:
+	default:
+		return nil, fmt.Errorf("unsupported selectStrategy `%s'", cfg.SelectStrategy)
+	}
+	if cfg.ForwardedForDepth < 0 {
+		return nil, fmt.Errorf("invalid forwardedForDepth %d", cfg.ForwardedForDepth)
+	}
+	if cfg.DBType == DBTypeCustom && len(cfg.Fields) == 0 {
+		return nil, fmt.Errorf("dbType `%s' needs fields", cfg.DBType)
+	}
+	for _, header := range cfg.Fields {
+		mw.fields = append(mw.fields, header)
+	}
+	sort.Strings(mw.fields)
+	if mw.customHeaders, err = parseCustomHeaders(cfg.CustomHeaders); err != nil {
+		return nil, err
+	}
+	mw.countryMaps = newCountryMaps(cfg.CountryMaps)
+	if mw.zones, err = loadGeoZones(cfg.GeoZonesPath); err != nil {
+		return nil, err
+	}
+	if mw.rules, err = newAccessRules(cfg, mw.zones); err != nil {
+		return nil, err
+	}
+	switch cfg.OnLookupError {
+	case "", LookupErrorAllow:
+		mw.failOpen = true
+	case LookupErrorBlock:
+	default:
+		return nil, fmt.Errorf("unsupported onLookupError `%s'", cfg.OnLookupError)
+	}
+	if mw.bypass, err = parseCIDRs("bypassCidrs", cfg.BypassCIDRs); err != nil {
+		return nil, err
+	}
+	if mw.ruleScope, err = newRequestMatches("rulesScope", cfg.RulesScope); err != nil {
+		return nil, err
+	}
+	if mw.ruleExceptions, err = newRequestMatches("rulesExceptions", cfg.RulesExceptions); err != nil {
+		return nil, err
+	}
+	if mw.limiter, err = newRateLimiter(cfg.CountryRateLimits); err != nil {
+		return nil, err
+	}
+	if mw.blocked, err = newBlockResponse(cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.LanguageHint {
+	case "", LanguageHintHeader, LanguageHintAcceptLanguage:
+		mw.languageHint = cfg.LanguageHint
+		mw.languages = newLanguages(cfg.Languages)
+	default:
+		return nil, fmt.Errorf("unsupported languageHint `%s'", cfg.LanguageHint)
+	}
+	mw.callingCode = cfg.CallingCode
+	if cfg.SignatureSecret != "" {
+		mw.signatureSecret = []byte(cfg.SignatureSecret)
+	}
+	known := mw.knownValues()
+	if mw.selected, err = newSelection(known, cfg.OutputFields, cfg.EnabledFields); err != nil {
+		return nil, err
+	}
+	if mw.cookie, err = newGeoCookie(cfg.Cookie); err != nil {
+		return nil, err
+	}
+	if mw.queryParams, err = mw.newQueryParams(known, cfg.QueryParams); err != nil {
+		return nil, err
+	}
+
+	watchInterval, err := parseInterval("watchInterval", cfg.WatchInterval)
+	if err != nil {
+		return nil, err
+	}
+	reloadInterval, err := parseInterval("reloadInterval", cfg.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	updateInterval, err := parseInterval("updateInterval", cfg.UpdateInterval)
+	if err != nil {
+		return nil, err
+	}
+	updateJitter := updateInterval / 10
+	if cfg.UpdateJitter != "" {
+		if updateJitter, err = parseInterval("updateJitter", cfg.UpdateJitter); err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.UpdateProtocol {
+	case "", UpdateProtocolDownload, UpdateProtocolGeoIPUpdate:
+	default:
+		return nil, fmt.Errorf("unsupported updateProtocol `%s'", cfg.UpdateProtocol)
+	}
+
+	retryInterval, err := parseInterval("retryInterval", cfg.RetryInterval)
+	if err != nil {
+		return nil, err
+	}
+	mw.lazyOpen, mw.retryEvery = cfg.LazyOpen, retryInterval
+	maxDBAge, err := parseInterval("maxDbAge", cfg.MaxDBAge)
+	if err != nil {
+		return nil, err
+	}
+	schedule := dbSchedule{
+		retry: retryInterval, watch: watchInterval, reload: reloadInterval,
+		update: updateInterval, jitter: updateJitter, maxAge: maxDBAge,
+	}
+
+	dbs := newDatabases(cfg)
+	if cfg.OverrideDBPath != "" {
+		dbs = append(dbs, newDatabase(cfg, cfg.OverrideDBPath, ""))
+	}
+
+	parts := mw.recordParts()
+	var failed []bool
+	for i, db := range dbs {
+		db.schedule, db.parts = schedule, parts
+		db = sharedDatabase(db)
+		mw.databases = append(mw.databases, db)
+		if cfg.OverrideDBPath != "" && i == len(dbs)-1 {
+			mw.override = db
+		}
+		if !cfg.LazyOpen && (db.getLookup() == nil || db.changed()) {
+			if err := db.open(); err != nil {
+				if cfg.FailOnError {
+					mw.release()
+					return nil, err
+				}
+				logErr.Print(err)
+			}
+			db.checkAge()
+		}
+		failed = append(failed, db.getLookup() == nil)
 	}
 
-	return &TraefikGeoIP2{
-		lookup: lookup,
-		next:   next,
-		name:   name,
-		cache:  cache.New(DefaultCacheExpire, DefaultCachePurge),
-	}, nil
+	if cfg.SharedCache {
+		mw.cacheKey = cacheKey(cfg, mw.databases)
+		mw.cache = sharedCache(mw.cacheKey)
+	} else {
+		mw.cache = cache.New(DefaultCacheExpire, DefaultCachePurge)
+	}
+
+	// Background jobs run once per shared database with its schedule, until the last
+	// instance using it is released with its context.
+	for i, db := range mw.databases {
+		db.addCache(mw.cache)
+		if failed[i] && db.schedule.retry > 0 && !cfg.LazyOpen && db.startJob("retry") {
+			go db.retry(db.ctx, db.schedule.retry)
+		}
+		if db.schedule.watch > 0 && db.startJob("watch") {
+			go db.watch(db.ctx, db.schedule.watch)
+		}
+		if db.schedule.reload > 0 && db.startJob("reload") {
+			go db.reloadEvery(db.ctx, db.schedule.reload)
+		}
+		if db.upd != nil && db.schedule.update > 0 && db.startJob("update") {
+			go db.updateEvery(db.ctx, db.schedule.update, db.schedule.jitter)
+		}
+	}
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			mw.release()
+		}()
+	}
+
+	return mw, nil
+}
+
+// parseInterval parses the duration of the option name, an empty value disables it.
+func parseInterval(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s `%s': %w", name, value, err)
+	}
+	return interval, nil
+}
+
+// errNoDatabase is returned for addresses the overrides do not answer when no database is open.
+var errNoDatabase = errors.New("no database open")
+
+// getLookup returns a lookup over all databases currently open, with lazyOpen it first
+// tries to open the others. When none is open, it returns the built-in fallback if
+// enabled and nil otherwise. The overrides answer first, then the override database
+// when it is open.
+func (mw *TraefikGeoIP2) getLookup() LookupGeoIP2 {
+	var lookups []LookupGeoIP2
+	for _, db := range mw.databases {
+		if mw.lazyOpen && db.getLookup() == nil && db.openOnDemand(mw.retryEvery) {
+			db.checkAge()
+		}
+		if lookup := db.getLookup(); lookup != nil && db != mw.override {
+			lookups = append(lookups, lookup)
+		}
+	}
+
+	var lookup LookupGeoIP2
+	switch len(lookups) {
+	case 0:
+		lookup = sourceLookup(SourceFallback, mw.fallback)
+	case 1:
+		lookup = sourceLookup(SourceDB, lookups[0])
+	default:
+		lookup = sourceLookup(SourceDB, MergeLookups(lookups...))
+	}
+	base := lookup
+	if base == nil {
+		base = func(ip net.IP) (*GeoIPResult, error) { return nil, errNoDatabase }
+	}
+	if mw.override != nil {
+		if override := mw.override.getLookup(); override != nil {
+			lookup = OverrideLookup(sourceLookup(SourceOverride, override), base)
+		}
+	}
+	if mw.static != nil {
+		if lookup == nil {
+			lookup = base
+		}
+		lookup = OverrideLookup(sourceLookup(SourceOverride, mw.static), lookup)
+	}
+	return lookup
+}
+
+// notFound reports whether err is returned for an address missing from the databases, not
+// for a failed lookup.
+func notFound(err error) bool {
+	return errors.Is(err, geoip2.ErrNotFound) || errors.Is(err, errNotInOverrides) ||
+		errors.Is(err, errNotInFallback) || errors.Is(err, errNotInIP2Location)
 }
 
 func (mw *TraefikGeoIP2) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if mw.lookup == nil {
-		logWarn.Printf("Unable to lookup remoteAddr: %v, xRealIp: %v", req.RemoteAddr, req.Header.Get(RealIPHeader))
-		mw.next.ServeHTTP(rw, mw.setGeoHeaders(req, &GeoIPResult{}))
+	if mw.reloadPath != "" && req.URL.Path == mw.reloadPath {
+		mw.serveReload(rw, req)
 		return
 	}
 
-	var start = time.Now()
-
-	ipStr := req.Header.Get(RealIPHeader)
-	if ipStr == "" {
-		ipStr = req.RemoteAddr
-		host, _, err := net.SplitHostPort(ipStr)
-		if err == nil {
-			ipStr = host
+	if mw.debug {
+		for _, db := range mw.databases {
+			rw.Header().Add(mw.header(DBInfoHeader), db.info())
 		}
 	}
 
-	var (
-		record *GeoIPResult
-		err    error
-	)
+	var spoofed bool
+	ipStr := mw.debugIP.ip(req)
+	if ipStr == "" {
+		ipStr, spoofed = mw.clientIP(req)
+	}
+	mw.stripGeoHeaders(req)
+	if spoofed {
+		req.Header.Set(mw.header(SpoofSuspectedHeader), "true")
+	}
+	if mw.peerLookup {
+		mw.setPeerHeaders(req, mw.getLookup())
+	}
 
-	if c, found := mw.cache.Get(ipStr); found {
-		record = c.(*GeoIPResult)
-	} else {
-		record, err = mw.lookup(net.ParseIP(ipStr))
-		if err != nil {
-			logWarn.Printf("Unable to find GeoIP data for `%s', %v", ipStr, err)
-			record = &GeoIPResult{
-				country: Unknown,
-				region:  Unknown,
-				city:    Unknown,
-			}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		// Requests without an IP, e.g. from unix sockets, are not looked up nor cached.
+		switch mw.invalidAddr {
+		case InvalidAddrSkip:
+			mw.next.ServeHTTP(rw, req)
+			return
+		case InvalidAddrPrivate:
+			mw.serve(rw, req, nil, &GeoIPResult{country: Private, region: Private, city: Private, source: SourcePrivate})
+			return
+		case InvalidAddrFallback:
+			ip, ipStr = mw.fallbackIP, mw.fallbackIP.String()
+		default:
+			mw.serve(rw, req, nil, &GeoIPResult{source: SourceNone})
+			return
 		}
-		mw.cache.Set(ipStr, record, cache.DefaultExpiration)
 	}
+	if mw.private && isPrivateIP(ip) {
+		mw.serve(rw, req, ip, &GeoIPResult{country: Private, region: Private, city: Private, source: SourcePrivate})
+		return
+	}
+
+	lookup := mw.getLookup()
+	if lookup == nil {
+		logWarn.Printf("Unable to lookup remoteAddr: %v, clientIp: %v", req.RemoteAddr, ipStr)
+		mw.serve(rw, req, ip, &GeoIPResult{source: SourceNone, failed: true})
+		return
+	}
+
+	var start = time.Now()
+
+	record := mw.cachedLookup(lookup, ip, ipStr)
 
 	duration := time.Since(start)
-	logInfo.Printf("remoteAddr: %v, xRealIp: %v, Country: %v, Region: %v, City: %v, duration: %d µs",
+	logInfo.Printf("remoteAddr: %v, clientIp: %v, Country: %v, Region: %v, City: %v, duration: %d µs",
 		req.RemoteAddr,
-		req.Header.Get(RealIPHeader),
+		ipStr,
 		record.country,
-		record.region,
-		record.city,
+		sanitize(record.region, mw.maxValueLength),
+		sanitize(record.city, mw.maxValueLength),
 		duration.Microseconds(),
 	)
+	if mw.debug {
+		rw.Header().Set(mw.header(DurationHeader), strconv.FormatInt(duration.Microseconds(), 10))
+	}
+
+	mw.serve(rw, req, ip, record)
+}
+
+// serve sets the values of record and passes req of the client at ip on to the next handler,
+// unless the access rules block the client or its country is rate limited. Clients in
+// bypassCidrs are never blocked nor limited, neither are requests the rules do not apply to.
+// Failed lookups are not blocked with the allow onLookupError.
+func (mw *TraefikGeoIP2) serve(rw http.ResponseWriter, req *http.Request, ip net.IP, record *GeoIPResult) {
+	req = mw.setGeoHeaders(rw, req, record)
+	if containsIP(mw.bypass, ip) || !mw.rulesApply(req) {
+		mw.next.ServeHTTP(rw, req)
+		return
+	}
+	if mw.rules != nil && !(record.failed && mw.failOpen) {
+		switch reason := mw.rules.blocks(record); {
+		case reason == "":
+		case mw.blocked.tag:
+			req.Header.Set(mw.header(BlockedHeader), sanitize(reason, mw.maxValueLength))
+		default:
+			mw.block(rw, req, ip, record, reason)
+			return
+		}
+	}
+	if mw.limiter != nil && record.country != Private {
+		if wait := mw.limiter.take(record.country, time.Now()); wait > 0 {
+			mw.throttle(rw, req, record.country, wait)
+			return
+		}
+	}
+	mw.next.ServeHTTP(rw, req)
+}
+
+// cachedLookup looks up ip, cached under key. Addresses not found have unknown values.
+func (mw *TraefikGeoIP2) cachedLookup(lookup LookupGeoIP2, ip net.IP, key string) *GeoIPResult {
+	if c, found := mw.cache.Get(key); found {
+		cached := *c.(*GeoIPResult)
+		cached.source = SourceCache
+		return &cached
+	}
+
+	record, err := lookup(ip)
+	if err != nil {
+		logWarn.Printf("Unable to find GeoIP data for `%s', %v", key, err)
+		record = &GeoIPResult{
+			country: Unknown,
+			region:  Unknown,
+			city:    Unknown,
+			source:  SourceNone,
+			failed:  !notFound(err),
+		}
+	} else {
+		record.sanitize()
+	}
+	mw.cache.Set(key, record, cache.DefaultExpiration)
+	return record
+}
+
+// setPeerHeaders sets the peer headers from the address of the connection, which differs
+// from the client IP behind proxies. Peer headers sent by the client are removed first.
+func (mw *TraefikGeoIP2) setPeerHeaders(req *http.Request, lookup LookupGeoIP2) {
+	for _, key := range []string{PeerCountryHeader, PeerRegionHeader, PeerCityHeader, PeerASNHeader} {
+		req.Header.Del(mw.header(key))
+	}
+	if lookup == nil {
+		return
+	}
+
+	peer := normalizeAddr(req.RemoteAddr)
+	ip := net.ParseIP(peer)
+
+	var record *GeoIPResult
+	switch {
+	case ip == nil:
+		return
+	case mw.private && isPrivateIP(ip):
+		record = &GeoIPResult{country: Private, region: Private, city: Private, source: SourcePrivate}
+	default:
+		record = mw.cachedLookup(lookup, ip, peer)
+	}
+
+	mw.placeValue("peerCountry", mw.header(PeerCountryHeader), mw.formatCountry(record.country)).apply(req.Header)
+	mw.encoded(mw.placeValue("peerRegion", mw.header(PeerRegionHeader), record.region)).apply(req.Header)
+	mw.encoded(mw.placeValue("peerCity", mw.header(PeerCityHeader), record.city)).apply(req.Header)
+	setOptionalHeader(req, mw.header(PeerASNHeader), formatUint(uint64(record.asn)))
+}
+
+// setGeoHeaders sets the values of record in the request headers, in the response headers
+// with setResponseHeaders and in the queryParams, and issues the cookie.
+// The returned request carries record in its context.
+func (mw *TraefikGeoIP2) setGeoHeaders(rw http.ResponseWriter, req *http.Request, record *GeoIPResult) *http.Request {
+	values := mw.geoValues(record)
+	mw.setValues(req.Header, values)
+	if mw.signatureSecret != nil {
+		mw.sign(req.Header, values)
+	}
+	if mw.responseHeaders {
+		mw.setValues(rw.Header(), values)
+	}
+	if mw.cookie != nil {
+		mw.cookie.set(rw, req, values)
+	}
+	if len(mw.queryParams) > 0 {
+		mw.setQueryParams(req, values)
+	}
+	if mw.languageHint == LanguageHintAcceptLanguage {
+		mw.setAcceptLanguage(req, record.country)
+	}
+	return req.WithContext(context.WithValue(req.Context(), ResultContextKey, record))
+}
 
-	mw.next.ServeHTTP(rw, mw.setGeoHeaders(req, record))
+// setValues sets values in header as configured by outputMode.
+func (mw *TraefikGeoIP2) setValues(header http.Header, values []geoValue) {
+	if mw.output != OutputJSON {
+		for _, value := range values {
+			value.apply(header)
+		}
+	}
+	if mw.output != OutputHeaders {
+		header.Set(mw.header(JSONHeader), geoJSON(values))
+	}
 }
 
-func (mw *TraefikGeoIP2) setGeoHeaders(req *http.Request, record *GeoIPResult) *http.Request {
-	if record.country == "" {
-		record.country = Unknown
+// stale returns "true" when a database in use is older than maxDbAge.
+func (mw *TraefikGeoIP2) stale() string {
+	for _, db := range mw.databases {
+		if db.stale() {
+			return "true"
+		}
 	}
+	return ""
+}
 
-	if record.region == "" {
-		record.region = Unknown
+// localizedName returns the name in the first of locales names has, "" when it has none.
+func localizedName(names map[string]string, locales []string) string {
+	for _, locale := range locales {
+		if name := names[locale]; name != "" {
+			return name
+		}
 	}
+	return ""
+}
 
-	if record.city == "" {
-		record.city = Unknown
+// stripGeoHeaders removes the headers with the plugin prefix and the configured header
+// names the client sent, so that the backend only sees values set by the plugin.
+func (mw *TraefikGeoIP2) stripGeoHeaders(req *http.Request) {
+	prefix := strings.ToLower(firstNonEmpty(mw.prefix, HeaderPrefix))
+	for key := range req.Header {
+		if strings.HasPrefix(strings.ToLower(key), prefix) {
+			req.Header.Del(key)
+		}
+	}
+	for _, key := range []string{mw.headers.Country, mw.headers.Region, mw.headers.City} {
+		req.Header.Del(key)
+	}
+	for _, key := range mw.fields {
+		req.Header.Del(key)
+	}
+	for _, custom := range mw.customHeaders {
+		req.Header.Del(custom.name)
 	}
+	for _, countryMap := range mw.countryMaps {
+		req.Header.Del(countryMap.header)
+	}
+	if mw.languageHint == LanguageHintHeader {
+		req.Header.Del(mw.languages.header)
+	}
+}
+
+// header returns the name of a header with the headerPrefix in place of X-GeoIP2-.
+func (mw *TraefikGeoIP2) header(name string) string {
+	if mw.prefix == "" || !strings.HasPrefix(name, HeaderPrefix) {
+		return name
+	}
+	return mw.prefix + strings.TrimPrefix(name, HeaderPrefix)
+}
 
-	req.Header.Set(CountryHeader, record.country)
-	req.Header.Set(RegionHeader, record.region)
-	req.Header.Set(CityHeader, record.city)
+// setOptionalHeader sets the header when the value is known and removes it otherwise,
+// so a client cannot supply the value itself.
+func setOptionalHeader(req *http.Request, key, value string) {
+	if value == "" {
+		req.Header.Del(key)
+		return
+	}
+	req.Header.Set(key, value)
+}
 
-	return req
+// formatUint formats a numeric database value, zero stands for an unknown value.
+func formatUint(value uint64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatUint(value, 10)
 }
@@ -1,10 +1,24 @@
 package traefikgeoip2_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	_ "time/tzdata"
 
 	mw "github.com/sopov/traefikgeoip2"
 )
@@ -33,6 +47,31 @@ func TestGeoIPConfig(t *testing.T) {
 	}
 }
 
+func TestGeoIPFailOnError(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.FailOnError = true
+
+	mwCfg.DBPath = "./non-existing"
+	_, err := mw.New(context.TODO(), nil, mwCfg, "")
+	if err == nil {
+		t.Fatalf("Must fail on missing DB")
+	}
+
+	mwCfg.DBPath = "Makefile"
+	_, err = mw.New(context.TODO(), nil, mwCfg, "")
+	if err == nil {
+		t.Fatalf("Must fail on invalid DB format")
+	}
+
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+	})
+	_, err = mw.New(context.TODO(), nil, mwCfg, "")
+	if err != nil {
+		t.Fatalf("Must not fail on valid DB: %v", err)
+	}
+}
+
 func TestGeoIPBasic(t *testing.T) {
 	mwCfg := mw.CreateConfig()
 	mwCfg.DBPath = "./GeoLite2-City.mmdb"
@@ -84,6 +123,27 @@ func TestMissingGeoIPDB(t *testing.T) {
 	assertHeader(t, req, mw.CityHeader, mw.Unknown)
 }
 
+func TestBuiltinFallback(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = "./missing"
+	mwCfg.BuiltinFallback = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "133.1.2.3:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "JP")
+	assertHeader(t, req, mw.RegionHeader, mw.Unknown)
+	assertHeader(t, req, mw.CityHeader, mw.Unknown)
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+}
+
 func TestGeoIPFromRemoteAddr(t *testing.T) {
 	mwCfg := mw.CreateConfig()
 	mwCfg.DBPath = "./GeoLite2-City.mmdb"
@@ -139,6 +199,2445 @@ func TestGeoIPFromXRealIP(t *testing.T) {
 	assertHeader(t, req, mw.CityHeader, "Munich")
 }
 
+func TestGeoIPMultipleDatabases(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		writeTestDB(t, dir, "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+			"188.193.88.0/24": testCountryRecord("AT"),
+			"1.1.1.0/24":      testCountryRecord("AU"),
+			"2a02:810d::/32":  testCountryRecord("DE"),
+		}),
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.RegionHeader, "Bavaria")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "AU")
+	assertHeader(t, req, mw.RegionHeader, mw.Unknown)
+	assertHeader(t, req, mw.CityHeader, mw.Unknown)
+
+	// IPv6 ranges missing from the City database still get a country.
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "[2a02:810d:1::1]:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, mw.Unknown)
+}
+
+func TestGeoIPOverrideDatabase(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.OverrideDBPath = writeTestDB(t, dir, "corrections.mmdb", "GeoIP2-City", map[string]interface{}{
+		"188.193.88.192/26": testCountryRecord("AT"),
+	})
+	mwCfg.FailOnError = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	// The override wins as a whole, its unknown city is not taken from the main database.
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "AT")
+	assertHeader(t, req, mw.CityHeader, mw.Unknown)
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "188.193.88.1:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPStaticOverrides(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.Overrides = []mw.Override{
+		{CIDR: "188.193.88.192/26", Country: "de", Region: "Berlin", City: "Berlin"},
+		{CIDR: "203.0.113.7", Country: "AT"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		country    string
+		city       string
+	}{
+		{remoteAddr: ValidIPAndPort, country: "DE", city: "Berlin"},
+		{remoteAddr: "188.193.88.1:9999", country: "DE", city: "Munich"},
+		{remoteAddr: "203.0.113.7:9999", country: "AT", city: mw.Unknown},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = test.remoteAddr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, test.country)
+		assertHeader(t, req, mw.CityHeader, test.city)
+	}
+
+	mwCfg.Overrides = []mw.Override{{CIDR: "203.0.113.0/33", Country: "AT"}}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid override")
+	}
+}
+
+func TestGeoIPHeaderNames(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.Headers = mw.HeaderNames{Country: "X-Country", City: "X-City"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Country", "DE")
+	assertHeader(t, req, "X-City", "Munich")
+	assertHeader(t, req, mw.RegionHeader, "Bavaria")
+	assertHeader(t, req, mw.CountryHeader, "")
+}
+
+func TestGeoIPLocation(t *testing.T) {
+	record := testCityRecord("DE", "Bavaria", "Munich")
+	record["location"] = map[string]interface{}{
+		"latitude":        48.1374,
+		"longitude":       11.5755,
+		"accuracy_radius": uint16(20),
+		"time_zone":       "Europe/Berlin",
+		"metro_code":      uint16(807),
+	}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": record,
+		"188.193.89.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.CoordinatePrecision = 2
+	mwCfg.GeoHashPrecision = 5
+	mwCfg.DistanceFrom = "50.1109, 8.6821"
+	mwCfg.EnabledFields = map[string]bool{"metroCode": true, "localTime": true}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.LatitudeHeader, "48.14")
+	assertHeader(t, req, mw.LongitudeHeader, "11.58")
+	assertHeader(t, req, mw.AccuracyRadiusHeader, "20")
+	assertHeader(t, req, mw.MetroCodeHeader, "807")
+	assertHeader(t, req, mw.GeoHashHeader, "u281z")
+	assertHeader(t, req, mw.DistanceHeader, "304")
+	localTime, err := time.Parse(time.RFC3339, req.Header.Get(mw.LocalTimeHeader))
+	if err != nil {
+		t.Fatalf("invalid value of header [%s]: %v", mw.LocalTimeHeader, err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	if localTime.Format(time.RFC3339) != localTime.In(berlin).Format(time.RFC3339) {
+		t.Errorf("invalid offset of header [%s] %q", mw.LocalTimeHeader, req.Header.Get(mw.LocalTimeHeader))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "188.193.89.1:9999"
+	req.Header.Set(mw.LatitudeHeader, "0")
+	req.Header.Set(mw.AccuracyRadiusHeader, "1")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.LatitudeHeader, "")
+	assertHeader(t, req, mw.AccuracyRadiusHeader, "")
+	assertHeader(t, req, mw.GeoHashHeader, "")
+	assertHeader(t, req, mw.LocalTimeHeader, "")
+	assertHeader(t, req, mw.DistanceHeader, "")
+
+	mwCfg.DistanceFrom = "91,0"
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an invalid distanceFrom")
+	}
+}
+
+func TestGeoIPRegionFormat(t *testing.T) {
+	record := testCityRecord("GB", "England", "London")
+	record["subdivisions"] = []interface{}{
+		map[string]interface{}{"iso_code": "ENG", "names": map[string]interface{}{"en": "England"}},
+		map[string]interface{}{"iso_code": "WSM", "names": map[string]interface{}{"en": "Westminster"}},
+	}
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"81.2.69.0/24":    record,
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+
+	tests := []struct {
+		format     string
+		remoteAddr string
+		separator  string
+		region     string
+		region2    string
+		all        string
+	}{
+		{format: mw.RegionFormatName, remoteAddr: "81.2.69.1:9999", region: "England", region2: "Westminster", all: "England/Westminster"},
+		{format: mw.RegionFormatName, remoteAddr: ValidIPAndPort, separator: ", ", region: "Bavaria", all: "Bavaria"},
+		{format: mw.RegionFormatCode, remoteAddr: "81.2.69.1:9999", separator: ", ", region: "GB-ENG", region2: "GB-WSM", all: "GB-ENG, GB-WSM"},
+		{format: mw.RegionFormatCode, remoteAddr: ValidIPAndPort, region: mw.Unknown},
+	}
+	for _, test := range tests {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.RegionFormat = test.format
+		if test.separator != "" {
+			mwCfg.SubdivisionSeparator = test.separator
+		}
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = test.remoteAddr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.RegionHeader, test.region)
+		assertHeader(t, req, mw.Region2Header, test.region2)
+		assertHeader(t, req, mw.SubdivisionsHeader, test.all)
+	}
+}
+
+func TestGeoIPLocales(t *testing.T) {
+	record := testCityRecord("DE", "Bavaria", "Munich")
+	record["country"] = map[string]interface{}{
+		"iso_code": "DE",
+		"names":    map[string]interface{}{"en": "Germany", "de": "Deutschland"},
+	}
+	record["subdivisions"] = []interface{}{
+		map[string]interface{}{"names": map[string]interface{}{"en": "Bavaria", "de": "Bayern"}},
+	}
+	record["city"] = map[string]interface{}{
+		"names": map[string]interface{}{"en": "Munich"},
+	}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": record,
+	})
+	mwCfg.Locales = []string{"fr", "de", "en"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CountryNameHeader, "Deutschland")
+	assertHeader(t, req, mw.RegionHeader, "Bayern")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPOmitUnknown(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+	})
+	mwCfg.UnknownBehaviour = mw.UnknownOmit
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.CityHeader, "Berlin")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, "")
+	if _, ok := req.Header[mw.RegionHeader]; ok {
+		t.Fatalf("Unknown region must be omitted")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.1:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	if _, ok := req.Header[mw.CountryHeader]; ok {
+		t.Fatalf("Unknown country must be omitted")
+	}
+}
+
+func TestGeoIPPlaceholder(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+	})
+	mwCfg.Placeholder = "N/A"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, "N/A")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.1:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "N/A")
+}
+
+func TestGeoIPHeaderPrefix(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		writeTestDB(t, dir, "GeoLite2-ASN.mmdb", "GeoLite2-ASN", map[string]interface{}{
+			"188.193.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(6805)},
+		}),
+	}
+	mwCfg.HeaderPrefix = "X-Client-Geo-"
+	mwCfg.Headers.City = "X-Town"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Client-Geo-Country", "DE")
+	assertHeader(t, req, "X-Client-Geo-Region", "Bavaria")
+	assertHeader(t, req, "X-Town", "Munich")
+	assertHeader(t, req, "X-Client-Geo-ASN", "6805")
+	assertHeader(t, req, mw.CountryHeader, "")
+	assertHeader(t, req, mw.ASNHeader, "")
+}
+
+func TestGeoIPOutputMode(t *testing.T) {
+	dir := t.TempDir()
+	dbPaths := []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		writeTestDB(t, dir, "GeoLite2-ASN.mmdb", "GeoLite2-ASN", map[string]interface{}{
+			"188.193.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(6805)},
+		}),
+	}
+
+	for _, tc := range []struct {
+		mode    string
+		country string
+		json    string
+	}{
+		{mode: mw.OutputHeaders, country: "DE"},
+		{mode: mw.OutputJSON, json: `{"asn":"6805","city":"Munich","continent":"EU","country":"DE","countryName":"DE","isAnycast":"false","network":"188.193.88.0/24","region":"Bavaria","source":"db","subdivisions":"Bavaria"}`},
+		{mode: mw.OutputBoth, country: "DE", json: `{"asn":"6805","city":"Munich","continent":"EU","country":"DE","countryName":"DE","isAnycast":"false","network":"188.193.88.0/24","region":"Bavaria","source":"db","subdivisions":"Bavaria"}`},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPaths = dbPaths
+		mwCfg.OutputMode = tc.mode
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		req.Header.Set(mw.JSONHeader, `{"country":"US"}`)
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, tc.country)
+		assertHeader(t, req, mw.JSONHeader, tc.json)
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.OutputMode = "xml"
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("expected error for outputMode %q", mwCfg.OutputMode)
+	}
+}
+
+func TestGeoIPSetResponseHeaders(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.SetResponseHeaders = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	rec := httptest.NewRecorder()
+	instance.ServeHTTP(rec, req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	for key, expected := range map[string]string{mw.CountryHeader: "DE", mw.RegionHeader: "Bavaria", mw.CityHeader: "Munich"} {
+		if actual := rec.Header().Get(key); actual != expected {
+			t.Errorf("invalid value of response header [%s] %q != %q", key, actual, expected)
+		}
+	}
+}
+
+func TestGeoIPResultContext(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+
+	var record *mw.GeoIPResult
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		record, _ = mw.ResultFromContext(req.Context())
+	})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	if record == nil {
+		t.Fatal("no lookup result in the request context")
+	}
+	if record.Country() != "DE" || record.Region() != "Bavaria" || record.City() != "Munich" {
+		t.Errorf("invalid lookup result %s/%s/%s", record.Country(), record.Region(), record.City())
+	}
+	if _, ok := mw.ResultFromContext(req.Context()); ok {
+		t.Error("lookup result in the context of the original request")
+	}
+}
+
+func TestGeoIPCustomHeaders(t *testing.T) {
+	record := testCityRecord("DE", "Bavaria", "Munich")
+	record["continent"] = map[string]interface{}{"code": "EU"}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": record,
+	})
+	mwCfg.CustomHeaders = map[string]string{
+		"X-Edge-Zone": "{{.Continent}}-{{.Country}}",
+		"X-Cache-Key": "{{.Country}}\n{{.City | printf \"%.3s\"}}",
+		"X-Empty":     "{{if .ASN}}{{.ASN}}{{end}}",
+		"X-Missing":   "{{.Planet}}",
+		"X-Source":    "{{.Source}}",
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set("X-Empty", "spoofed")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Edge-Zone", "EU-DE")
+	assertHeader(t, req, "X-Cache-Key", "DE Mun")
+	assertHeader(t, req, "X-Empty", "")
+	assertHeader(t, req, "X-Missing", "")
+	assertHeader(t, req, "X-Source", mw.SourceDB)
+
+	mwCfg.CustomHeaders = map[string]string{"X-Broken": "{{.Country"}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an invalid template")
+	}
+}
+
+func TestGeoIPNameEncoding(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("BR", "São Paulo", "São José dos Campos"),
+	})
+
+	for _, tc := range []struct {
+		encoding string
+		region   string
+		city     string
+	}{
+		{encoding: "", region: "São Paulo", city: "São José dos Campos"},
+		{encoding: mw.NameEncodingPercent, region: "S%C3%A3o%20Paulo", city: "S%C3%A3o%20Jos%C3%A9%20dos%20Campos"},
+		{encoding: mw.NameEncodingASCII, region: "Sao Paulo", city: "Sao Jose dos Campos"},
+		{encoding: mw.NameEncodingRFC8187, region: "UTF-8''S%C3%A3o%20Paulo", city: "UTF-8''S%C3%A3o%20Jos%C3%A9%20dos%20Campos"},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.NameEncoding = tc.encoding
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, "BR")
+		assertHeader(t, req, mw.RegionHeader, tc.region)
+		assertHeader(t, req, mw.CityHeader, tc.city)
+	}
+}
+
+func TestGeoIPCountryFormat(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+
+	for _, tc := range []struct {
+		format   string
+		caseName string
+		expected string
+	}{
+		{expected: "DE"},
+		{caseName: mw.CaseLower, expected: "de"},
+		{format: mw.CountryFormatAlpha3, expected: "DEU"},
+		{format: mw.CountryFormatAlpha3, caseName: mw.CaseLower, expected: "deu"},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.CountryFormat = tc.format
+		mwCfg.CountryCase = tc.caseName
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, tc.expected)
+
+		req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "1.1.1.1:9999"
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+	}
+}
+
+func TestGeoIPCookie(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.Cookie = mw.GeoCookie{Name: "geo", TTL: "24h", Secure: true, SameSite: "Lax"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	rec := httptest.NewRecorder()
+	instance.ServeHTTP(rec, req)
+	expected := "geo=country=DE&region=Bavaria; Path=/; Max-Age=86400; Secure; SameSite=Lax"
+	if actual := rec.Header().Get("Set-Cookie"); actual != expected {
+		t.Fatalf("invalid cookie %q != %q", actual, expected)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.AddCookie(&http.Cookie{Name: "geo", Value: "country=DE&region=Bavaria"})
+	rec = httptest.NewRecorder()
+	instance.ServeHTTP(rec, req)
+	if actual := rec.Header().Get("Set-Cookie"); actual != "" {
+		t.Errorf("cookie issued again: %q", actual)
+	}
+
+	mwCfg.Cookie.SameSite = "sometimes"
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an invalid sameSite")
+	}
+}
+
+func TestGeoIPQueryParams(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.QueryParams = map[string]string{"country": "geo_country", "region": "", "asn": "asn"}
+
+	var query url.Values
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query = req.URL.Query()
+	})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/?page=2&geo_country=US&asn=1", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	expected := url.Values{"page": {"2"}, "geo_country": {"DE"}, "region": {"Bavaria"}}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("invalid query %v != %v", query, expected)
+	}
+
+	mwCfg.QueryParams = map[string]string{"planet": "planet"}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an unknown value")
+	}
+
+	mwCfg.QueryParams = map[string]string{"city": "city"}
+	mwCfg.OutputFields = []string{"country"}
+	_, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err == nil || !strings.Contains(err.Error(), "not selected") {
+		t.Fatalf("expected error for a value not selected, got %v", err)
+	}
+	mwCfg.OutputFields = nil
+	mwCfg.EnabledFields = map[string]bool{"city": false}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for a value turned off")
+	}
+}
+
+func TestGeoIPCountryMaps(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+		"81.2.69.0/24":    testCountryRecord("GB"),
+		"1.1.1.0/24":      testCountryRecord("AU"),
+	})
+	mwCfg.CountryMaps = map[string]map[string]string{
+		"X-Geo-Sales-Region": {"de": "emea", "GB": "emea", "US": "amer"},
+		"X-Geo-Tier":         {"DE": "1", "*": "2"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		sales      string
+		tier       string
+	}{
+		{remoteAddr: ValidIPAndPort, sales: "emea", tier: "1"},
+		{remoteAddr: "81.2.69.142:9999", sales: "emea", tier: "2"},
+		{remoteAddr: "1.1.1.1:9999", sales: "", tier: "2"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Geo-Sales-Region", "spoofed")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, "X-Geo-Sales-Region", tc.sales)
+		assertHeader(t, req, "X-Geo-Tier", tc.tier)
+	}
+}
+
+func TestGeoIPCountryCodes(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+		"81.2.69.0/24":    testCountryRecord("GB"),
+		"1.1.1.0/24":      testCountryRecord("AQ"),
+	})
+	mwCfg.CallingCode = true
+	mwCfg.EnabledFields = map[string]bool{"currency": true}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr  string
+		continent   string
+		currency    string
+		callingCode string
+	}{
+		{remoteAddr: ValidIPAndPort, continent: "EU", currency: "EUR", callingCode: "+49"},
+		{remoteAddr: "81.2.69.142:9999", continent: "EU", currency: "GBP", callingCode: "+44"},
+		{remoteAddr: "1.1.1.1:9999", continent: "AN", currency: "", callingCode: "+672"},
+		{remoteAddr: "10.0.0.1:9999", continent: "", currency: "", callingCode: ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set(mw.CurrencyHeader, "spoofed")
+		req.Header.Set(mw.CallingCodeHeader, "spoofed")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.ContinentHeader, tc.continent)
+		assertHeader(t, req, mw.CurrencyHeader, tc.currency)
+		assertHeader(t, req, mw.CallingCodeHeader, tc.callingCode)
+	}
+}
+
+func TestGeoIPSignature(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+	})
+
+	for _, mode := range []string{mw.OutputHeaders, mw.OutputJSON} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.OutputMode = mode
+		mwCfg.SignatureSecret = "secret"
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		req.Header.Set(mw.SignatureHeader, "spoofed")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+
+		var names []string
+		for name := range req.Header {
+			if name != http.CanonicalHeaderKey(mw.SignatureHeader) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if mode == mw.OutputJSON && !reflect.DeepEqual(names, []string{http.CanonicalHeaderKey(mw.JSONHeader)}) {
+			t.Errorf("unexpected headers %v with outputMode %s", names, mode)
+		}
+		mac := hmac.New(sha256.New, []byte("secret"))
+		for _, name := range names {
+			mac.Write([]byte(name + ": " + req.Header.Get(name) + "\n"))
+		}
+		assertHeader(t, req, mw.SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+func TestGeoIPSanitize(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bayern\tFreistaat", "M\u00fcn\r\nchen\x00\x7f"),
+		"81.2.69.0/24":    testCityRecord("GB", strings.Repeat("\u00e4", 300), "London"),
+	})
+	record := testCityRecord("DE", "Bavaria", "Munich")
+	record["traits"] = map[string]interface{}{"user_type": "resi\r\ndential", "connection_type": "Cable\x00/DSL"}
+	mwCfg.DBPaths = []string{mwCfg.DBPath, writeTestDB(t, t.TempDir(), "GeoIP2-Enterprise.mmdb", "GeoIP2-Enterprise", map[string]interface{}{
+		"188.193.88.0/24": record,
+	})}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.RegionHeader, "BayernFreistaat")
+	assertHeader(t, req, mw.CityHeader, "M\u00fcnchen")
+	assertHeader(t, req, mw.UserTypeHeader, "residential")
+	assertHeader(t, req, mw.ConnectionTypeHeader, "Cable/DSL")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.142:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.RegionHeader, strings.Repeat("\u00e4", mw.DefaultMaxValueLength/2))
+
+	mwCfg.MaxValueLength = 5
+	instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.142:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.RegionHeader, "\u00e4\u00e4")
+	assertHeader(t, req, mw.CityHeader, "Londo")
+
+	// The cap applies to the encoded value, which is not cut within a character.
+	mwCfg.NameEncoding = mw.NameEncodingPercent
+	for _, tc := range []struct {
+		maxLength int
+		expected  string
+	}{
+		{maxLength: 8, expected: "%C3%A4"},
+		{maxLength: 10, expected: "%C3%A4"},
+		{maxLength: 12, expected: "%C3%A4%C3%A4"},
+	} {
+		mwCfg.MaxValueLength = tc.maxLength
+		instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+		req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "81.2.69.142:9999"
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.RegionHeader, tc.expected)
+	}
+	mwCfg.NameEncoding = ""
+
+	mwCfg.MaxValueLength = -1
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an invalid maxValueLength")
+	}
+}
+
+func TestGeoIPLanguageHint(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+		"81.2.69.0/24":    testCountryRecord("CH"),
+		"1.1.1.0/24":      testCountryRecord("AQ"),
+	})
+	mwCfg.LanguageHint = mw.LanguageHintHeader
+	mwCfg.Languages = map[string]string{"ch": "fr-CH"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		language   string
+	}{
+		{remoteAddr: ValidIPAndPort, language: "de-DE"},
+		{remoteAddr: "81.2.69.142:9999", language: "fr-CH"},
+		{remoteAddr: "1.1.1.1:9999", language: ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set(mw.SuggestedLanguageHeader, "spoofed")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.SuggestedLanguageHeader, tc.language)
+		assertHeader(t, req, mw.AcceptLanguageHeader, "")
+	}
+
+	mwCfg.LanguageHint = mw.LanguageHintAcceptLanguage
+	mwCfg.Languages = map[string]string{"*": "en"}
+	instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		sent       string
+		language   string
+	}{
+		{remoteAddr: ValidIPAndPort, language: "de-DE"},
+		{remoteAddr: ValidIPAndPort, sent: "en-US", language: "en-US"},
+		{remoteAddr: "1.1.1.1:9999", language: "en"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.sent != "" {
+			req.Header.Set(mw.AcceptLanguageHeader, tc.sent)
+		}
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.AcceptLanguageHeader, tc.language)
+		assertHeader(t, req, mw.SuggestedLanguageHeader, "")
+	}
+
+	mwCfg.LanguageHint = "cookie"
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an unsupported languageHint")
+	}
+}
+
+func TestGeoIPOutputFields(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		writeTestDB(t, dir, "GeoLite2-ASN.mmdb", "GeoLite2-ASN", map[string]interface{}{
+			"188.193.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(6805)},
+		}),
+	}
+	mwCfg.OutputFields = []string{"country"}
+	mwCfg.OutputMode = mw.OutputBoth
+
+	var result *mw.GeoIPResult
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		result, _ = mw.ResultFromContext(req.Context())
+	})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set(mw.CityHeader, "Berlin")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.RegionHeader, "")
+	assertHeader(t, req, mw.CityHeader, "")
+	assertHeader(t, req, mw.ASNHeader, "")
+	assertHeader(t, req, mw.JSONHeader, `{"country":"DE"}`)
+	if result == nil || result.Region() == "Bavaria" || result.City() != "" {
+		t.Errorf("region and city extracted without being selected: %+v", result)
+	}
+
+	// Rules on cities need the city even though it is not set.
+	mwCfg.BlockedCities = []string{"Berlin"}
+	if instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "")
+	if result == nil || result.Region() == "Bavaria" || result.City() != "Munich" {
+		t.Errorf("invalid parts extracted for the city rules: %+v", result)
+	}
+	mwCfg.BlockedCities = nil
+
+	mwCfg.OutputFields = []string{"country", "planet"}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an unknown value")
+	}
+}
+
+func TestGeoIPEnabledFields(t *testing.T) {
+	record := testCityRecord("DE", "Bavaria", "Munich")
+	record["location"] = map[string]interface{}{"latitude": 48.1374, "longitude": 11.5755, "accuracy_radius": uint16(20)}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": record,
+	})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for _, tc := range []struct {
+		enabled  map[string]bool
+		city     string
+		latitude string
+		accuracy string
+	}{
+		{enabled: map[string]bool{"city": false}, city: "", latitude: "48.1374", accuracy: "20"},
+		{enabled: map[string]bool{"country": true, "city": false, "latlong": true}, city: "", latitude: "48.1374", accuracy: ""},
+		{enabled: map[string]bool{"latlong": false}, city: "Munich", latitude: "", accuracy: "20"},
+		{enabled: map[string]bool{"metroCode": true}, city: "Munich", latitude: "48.1374", accuracy: "20"},
+	} {
+		mwCfg.EnabledFields = tc.enabled
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CountryHeader, "DE")
+		assertHeader(t, req, mw.CityHeader, tc.city)
+		assertHeader(t, req, mw.LatitudeHeader, tc.latitude)
+		assertHeader(t, req, mw.AccuracyRadiusHeader, tc.accuracy)
+	}
+
+	mwCfg.EnabledFields = map[string]bool{"planet": true}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an unknown value")
+	}
+}
+
+func TestGeoIPSource(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.Overrides = []mw.Override{{CIDR: "10.0.0.0/8", Country: "DE"}}
+	mwCfg.SkipPrivate = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: ValidIPAndPort, expected: mw.SourceDB},
+		{remoteAddr: ValidIPAndPort, expected: mw.SourceCache},
+		{remoteAddr: "81.2.69.142:9999", expected: mw.SourceNone},
+		{remoteAddr: "192.168.1.1:9999", expected: mw.SourcePrivate},
+		{remoteAddr: "unix", expected: mw.SourceNone},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.SourceHeader, tc.expected)
+	}
+
+	mwCfg.SkipPrivate = false
+	instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "10.1.2.3:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.SourceHeader, mw.SourceOverride)
+}
+
+func TestGeoIPRegisteredCountry(t *testing.T) {
+	record := testCountryRecord("DE")
+	record["registered_country"] = map[string]interface{}{"iso_code": "US"}
+	record["represented_country"] = map[string]interface{}{"iso_code": "US", "type": "military"}
+	record["traits"] = map[string]interface{}{"is_satellite_provider": true}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": record,
+		"81.2.69.0/24":    testCountryRecord("GB"),
+	})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	// The values are optional, headers of the client are left as they are without them.
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.RegisteredCountryHeader, "")
+	assertHeader(t, req, mw.IsSatelliteProviderHeader, "")
+
+	mwCfg.EnabledFields = map[string]bool{
+		"registeredCountry": true, "representedCountry": true, "isAnonymousProxy": true, "isSatelliteProvider": true,
+	}
+	instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.RegisteredCountryHeader, "US")
+	assertHeader(t, req, mw.RepresentedCountryHeader, "US")
+	assertHeader(t, req, mw.IsAnonymousProxyHeader, "false")
+	assertHeader(t, req, mw.IsSatelliteProviderHeader, "true")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.142:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "GB")
+	assertHeader(t, req, mw.RegisteredCountryHeader, "")
+	assertHeader(t, req, mw.RepresentedCountryHeader, "")
+}
+
+func TestGeoIPNetwork(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"81.2.69.0/24":    testCityRecord("GB", "England", "London"),
+		"188.193.88.0/21": testCityRecord("DE", "Bavaria", "Munich"),
+		"2001:db8::/32":   testCityRecord("GB", "England", "London"),
+	})
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: "81.2.69.142:9999", expected: "81.2.69.0/24"},
+		{remoteAddr: ValidIPAndPort, expected: "188.193.88.0/21"},
+		{remoteAddr: "[2001:db8::1]:9999", expected: "2001:db8::/32"},
+		{remoteAddr: "1.1.1.1:9999", expected: ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set(mw.NetworkHeader, "0.0.0.0/0")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.NetworkHeader, tc.expected)
+	}
+}
+
+func TestGeoIPAnycast(t *testing.T) {
+	record := testCityRecord("US", "California", "San Francisco")
+	record["subdivisions"] = []interface{}{
+		map[string]interface{}{"iso_code": "CA", "names": map[string]interface{}{"en": "California"}},
+	}
+	record["location"] = map[string]interface{}{"latitude": 37.7749, "longitude": -122.4194}
+	record["traits"] = map[string]interface{}{"is_anycast": true}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"1.1.1.0/24":      record,
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.RegionFormat = mw.RegionFormatCode
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "US")
+	assertHeader(t, req, mw.RegionHeader, "US-CA")
+	assertHeader(t, req, mw.CityHeader, "San Francisco")
+	assertHeader(t, req, mw.LatitudeHeader, "37.7749")
+	assertHeader(t, req, mw.IsAnycastHeader, "true")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.IsAnycastHeader, "false")
+}
+
+func TestGeoIPCountryRules(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+		"81.2.69.0/24":    testCountryRecord("GB"),
+	})
+
+	for _, tc := range []struct {
+		allowed    []string
+		blocked    []string
+		bypass     []string
+		remoteAddr string
+		status     int
+	}{
+		{blocked: []string{"gb"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{blocked: []string{"gb"}, remoteAddr: "81.2.69.142:9999", status: http.StatusForbidden},
+		{blocked: []string{"gb"}, remoteAddr: "1.1.1.1:9999", status: http.StatusOK},
+		{allowed: []string{"DE"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{allowed: []string{"DE"}, remoteAddr: "81.2.69.142:9999", status: http.StatusForbidden},
+		{allowed: []string{"DE"}, remoteAddr: "1.1.1.1:9999", status: http.StatusForbidden},
+		{allowed: []string{"DE"}, remoteAddr: "10.0.0.1:9999", status: http.StatusOK},
+		{allowed: []string{"DE", "GB"}, blocked: []string{"GB"}, remoteAddr: "81.2.69.142:9999", status: http.StatusForbidden},
+		{blocked: []string{"GB"}, bypass: []string{"81.2.69.128/25"}, remoteAddr: "81.2.69.142:9999", status: http.StatusOK},
+		{blocked: []string{"GB"}, bypass: []string{"81.2.69.0/25"}, remoteAddr: "81.2.69.142:9999", status: http.StatusForbidden},
+		{allowed: []string{"DE"}, bypass: []string{"1.1.1.1"}, remoteAddr: "1.1.1.1:9999", status: http.StatusOK},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.AllowedCountries = tc.allowed
+		mwCfg.BlockedCountries = tc.blocked
+		mwCfg.BypassCIDRs = tc.bypass
+		mwCfg.SkipPrivate = true
+
+		called := false
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true })
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status || called != (tc.status == http.StatusOK) {
+			t.Errorf("%v/%v %s: status %d, next called %v", tc.allowed, tc.blocked, tc.remoteAddr, rw.Code, called)
+		}
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.BypassCIDRs = []string{"81.2.69.0/33"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Error("expected error for invalid bypassCidrs")
+	}
+}
+
+func TestGeoIPOnLookupError(t *testing.T) {
+	for _, tc := range []struct {
+		onLookupError string
+		overrides     []mw.Override
+		remoteAddr    string
+		status        int
+	}{
+		{remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{onLookupError: mw.LookupErrorAllow, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{onLookupError: mw.LookupErrorBlock, remoteAddr: ValidIPAndPort, status: http.StatusForbidden},
+		{overrides: []mw.Override{{CIDR: "81.2.69.0/24", Country: "GB"}}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{overrides: []mw.Override{{CIDR: "81.2.69.0/24", Country: "GB"}}, remoteAddr: "81.2.69.142:9999", status: http.StatusForbidden},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+		mwCfg.AllowedCountries = []string{"DE"}
+		mwCfg.OnLookupError = tc.onLookupError
+		mwCfg.Overrides = tc.overrides
+
+		called := false
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true })
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status || called != (tc.status == http.StatusOK) {
+			t.Errorf("%q %v %s: status %d, next called %v", tc.onLookupError, tc.overrides, tc.remoteAddr, rw.Code, called)
+		}
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.OnLookupError = "ignore"
+	if _, err := mw.New(context.TODO(), nil, mwCfg, "traefik-geoip2"); err == nil {
+		t.Error("expected error for invalid onLookupError")
+	}
+}
+
+func TestGeoIPRulesScope(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"81.2.69.0/24": testCountryRecord("GB"),
+	})
+
+	scope := []mw.RequestMatch{{PathPrefix: "/signup", Methods: []string{"post"}}, {PathRegex: `^/api/v[0-9]+/`}}
+	exceptions := []mw.RequestMatch{{PathPrefix: "/robots.txt"}, {PathPrefix: "/healthz"}}
+	for _, tc := range []struct {
+		scope      []mw.RequestMatch
+		exceptions []mw.RequestMatch
+		method     string
+		path       string
+		status     int
+	}{
+		{method: http.MethodGet, path: "/", status: http.StatusForbidden},
+		{exceptions: exceptions, method: http.MethodGet, path: "/", status: http.StatusForbidden},
+		{exceptions: exceptions, method: http.MethodGet, path: "/robots.txt", status: http.StatusOK},
+		{exceptions: exceptions, method: http.MethodHead, path: "/healthz/live", status: http.StatusOK},
+		{scope: scope, method: http.MethodPost, path: "/signup", status: http.StatusForbidden},
+		{scope: scope, method: http.MethodGet, path: "/signup", status: http.StatusOK},
+		{scope: scope, method: http.MethodPost, path: "/login", status: http.StatusOK},
+		{scope: scope, method: http.MethodGet, path: "/api/v2/users", status: http.StatusForbidden},
+		{scope: scope, exceptions: []mw.RequestMatch{{PathRegex: "/public$"}}, method: http.MethodGet, path: "/api/v2/public", status: http.StatusOK},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.BlockedCountries = []string{"GB"}
+		mwCfg.RulesScope = tc.scope
+		mwCfg.RulesExceptions = tc.exceptions
+
+		called := false
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true })
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(tc.method, "http://localhost"+tc.path, nil)
+		req.RemoteAddr = "81.2.69.142:9999"
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status || called != (tc.status == http.StatusOK) {
+			t.Errorf("%s %s: status %d, next called %v", tc.method, tc.path, rw.Code, called)
+		}
+	}
+
+	for _, matches := range [][]mw.RequestMatch{{{}}, {{PathRegex: "(unclosed"}}} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.RulesScope = matches
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Errorf("expected error for rulesScope %v", matches)
+		}
+	}
+}
+
+func TestGeoIPCountryRateLimits(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+		"81.2.69.0/24":    testCountryRecord("GB"),
+	})
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = dbPath
+	mwCfg.CountryRateLimits = map[string]mw.RateLimit{
+		"gb": {Average: 0.01, Burst: 2},
+		"*":  {Average: 0.01, Burst: 3},
+	}
+	mwCfg.BypassCIDRs = []string{"81.2.69.200"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		status     int
+	}{
+		{remoteAddr: "81.2.69.142:9999", status: http.StatusOK},
+		{remoteAddr: "81.2.69.143:9999", status: http.StatusOK},
+		{remoteAddr: "81.2.69.142:9999", status: http.StatusTooManyRequests},
+		{remoteAddr: "81.2.69.200:9999", status: http.StatusOK},
+		{remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{remoteAddr: ValidIPAndPort, status: http.StatusTooManyRequests},
+		{remoteAddr: "1.1.1.1:9999", status: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status {
+			t.Errorf("%s: status %d != %d", tc.remoteAddr, rw.Code, tc.status)
+		}
+		if retry := rw.Header().Get(mw.RetryAfterHeader); (retry != "") != (tc.status == http.StatusTooManyRequests) || retry == "0" {
+			t.Errorf("%s: Retry-After `%s'", tc.remoteAddr, retry)
+		}
+	}
+
+	mwCfg = mw.CreateConfig()
+	mwCfg.CountryRateLimits = map[string]mw.RateLimit{"DE": {Burst: 10}}
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Error("expected error for countryRateLimits without average")
+	}
+}
+
+func TestGeoIPContinentRules(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+		"8.8.8.0/24":      testCountryRecord("US"),
+		"1.0.0.0/24":      testCountryRecord("AU"),
+	})
+
+	for _, tc := range []struct {
+		allowed    []string
+		blocked    []string
+		remoteAddr string
+		status     int
+	}{
+		{allowed: []string{"EU", "na"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{allowed: []string{"EU", "na"}, remoteAddr: "8.8.8.8:9999", status: http.StatusOK},
+		{allowed: []string{"EU", "na"}, remoteAddr: "1.0.0.1:9999", status: http.StatusForbidden},
+		{allowed: []string{"EU", "na"}, remoteAddr: "1.1.1.1:9999", status: http.StatusForbidden},
+		{blocked: []string{"OC"}, remoteAddr: "1.0.0.1:9999", status: http.StatusForbidden},
+		{blocked: []string{"OC"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.AllowedContinents = tc.allowed
+		mwCfg.BlockedContinents = tc.blocked
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status {
+			t.Errorf("%v/%v %s: status %d != %d", tc.allowed, tc.blocked, tc.remoteAddr, rw.Code, tc.status)
+		}
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.AllowedContinents = []string{"Europe"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an unsupported continent")
+	}
+}
+
+func TestGeoIPRegionRules(t *testing.T) {
+	subdivisions := func(codes ...string) []interface{} {
+		values := make([]interface{}, 0, len(codes))
+		for _, code := range codes {
+			values = append(values, map[string]interface{}{"iso_code": code, "names": map[string]interface{}{"en": code}})
+		}
+		return values
+	}
+	california := testCityRecord("US", "California", "Los Angeles")
+	california["subdivisions"] = subdivisions("CA")
+	texas := testCityRecord("US", "Texas", "Austin")
+	texas["subdivisions"] = subdivisions("TX")
+	london := testCityRecord("GB", "England", "London")
+	london["subdivisions"] = subdivisions("ENG", "WSM")
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"8.8.8.0/24":   california,
+		"8.8.4.0/24":   texas,
+		"81.2.69.0/24": london,
+	})
+
+	for _, tc := range []struct {
+		cfg        func(cfg *mw.Config)
+		remoteAddr string
+		status     int
+	}{
+		{cfg: func(cfg *mw.Config) { cfg.BlockedRegions = []string{"us-tx"} }, remoteAddr: "8.8.4.4:9999", status: http.StatusForbidden},
+		{cfg: func(cfg *mw.Config) { cfg.BlockedRegions = []string{"us-tx"} }, remoteAddr: "8.8.8.8:9999", status: http.StatusOK},
+		{cfg: func(cfg *mw.Config) { cfg.BlockedRegions = []string{"GB-WSM"} }, remoteAddr: "81.2.69.142:9999", status: http.StatusForbidden},
+		{cfg: func(cfg *mw.Config) { cfg.AllowedRegions = []string{"US-CA", "GB-ENG"} }, remoteAddr: "8.8.8.8:9999", status: http.StatusOK},
+		{cfg: func(cfg *mw.Config) { cfg.AllowedRegions = []string{"US-CA", "GB-ENG"} }, remoteAddr: "81.2.69.142:9999", status: http.StatusOK},
+		{cfg: func(cfg *mw.Config) { cfg.AllowedRegions = []string{"US-CA", "GB-ENG"} }, remoteAddr: "8.8.4.4:9999", status: http.StatusForbidden},
+		{cfg: func(cfg *mw.Config) { cfg.AllowedRegions = []string{"US-CA", "GB-ENG"} }, remoteAddr: "1.1.1.1:9999", status: http.StatusForbidden},
+		{cfg: func(cfg *mw.Config) { cfg.BlockedCities = []string{"austin"} }, remoteAddr: "8.8.4.4:9999", status: http.StatusForbidden},
+		{cfg: func(cfg *mw.Config) { cfg.BlockedCities = []string{"austin"} }, remoteAddr: "8.8.8.8:9999", status: http.StatusOK},
+		{cfg: func(cfg *mw.Config) { cfg.AllowedCities = []string{"London"} }, remoteAddr: "81.2.69.142:9999", status: http.StatusOK},
+		{cfg: func(cfg *mw.Config) { cfg.AllowedCities = []string{"London"} }, remoteAddr: "8.8.8.8:9999", status: http.StatusForbidden},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		tc.cfg(mwCfg)
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status {
+			t.Errorf("%v/%v %v/%v %s: status %d != %d", mwCfg.AllowedRegions, mwCfg.BlockedRegions,
+				mwCfg.AllowedCities, mwCfg.BlockedCities, tc.remoteAddr, rw.Code, tc.status)
+		}
+	}
+}
+
+func TestGeoIPGeofences(t *testing.T) {
+	located := func(city string, latitude, longitude float64) map[string]interface{} {
+		record := testCityRecord("DE", "", city)
+		record["location"] = map[string]interface{}{"latitude": latitude, "longitude": longitude}
+		return record
+	}
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": located("Munich", 48.1374, 11.5755),
+		"188.193.89.0/24": located("Augsburg", 48.3705, 10.8978),
+		"91.0.0.0/24":     located("Frankfurt", 50.1109, 8.6821),
+		"91.0.1.0/24":     testCityRecord("DE", "", ""),
+	})
+
+	allow := []mw.Geofence{{Center: "48.1374,11.5755", RadiusKm: 80}}
+	block := []mw.Geofence{{Center: "48.1374,11.5755", RadiusKm: 80, Action: mw.GeofenceBlock}}
+	for _, tc := range []struct {
+		fences     []mw.Geofence
+		remoteAddr string
+		status     int
+	}{
+		{fences: allow, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{fences: allow, remoteAddr: "188.193.89.1:9999", status: http.StatusOK},
+		{fences: allow, remoteAddr: "91.0.0.1:9999", status: http.StatusForbidden},
+		{fences: allow, remoteAddr: "91.0.1.1:9999", status: http.StatusForbidden},
+		{fences: block, remoteAddr: ValidIPAndPort, status: http.StatusForbidden},
+		{fences: block, remoteAddr: "91.0.0.1:9999", status: http.StatusOK},
+		{fences: block, remoteAddr: "91.0.1.1:9999", status: http.StatusOK},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.Geofences = tc.fences
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status {
+			t.Errorf("%v %s: status %d != %d", tc.fences, tc.remoteAddr, rw.Code, tc.status)
+		}
+	}
+
+	for _, fence := range []mw.Geofence{
+		{Center: "48.1374", RadiusKm: 50},
+		{Center: "48.1374,11.5755"},
+		{Center: "48.1374,11.5755", RadiusKm: 50, Action: "tag"},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.Geofences = []mw.Geofence{fence}
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Errorf("expected error for geofence %v", fence)
+		}
+	}
+}
+
+func TestGeoIPGeoZones(t *testing.T) {
+	located := func(city string, latitude, longitude float64) map[string]interface{} {
+		record := testCityRecord("DE", "", city)
+		record["location"] = map[string]interface{}{"latitude": latitude, "longitude": longitude}
+		return record
+	}
+	dir := t.TempDir()
+	dbPath := writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": located("Munich", 48.1374, 11.5755),
+		"188.193.89.0/24": located("Augsburg", 48.3705, 10.8978),
+		"91.0.0.0/24":     located("Frankfurt", 50.1109, 8.6821),
+		"91.0.1.0/24":     located("Hamburg", 53.5511, 9.9937),
+	})
+	zonesPath := filepath.Join(dir, "zones.geojson")
+	zones := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "south"}, "geometry": {"type": "Polygon", "coordinates": [
+			[[10.5, 47.5], [12, 47.5], [12, 48.5], [10.5, 48.5], [10.5, 47.5]],
+			[[10.85, 48.33], [10.95, 48.33], [10.95, 48.4], [10.85, 48.4], [10.85, 48.33]]
+		]}},
+		{"type": "Feature", "properties": {"name": "rhine-main"}, "geometry": {"type": "MultiPolygon", "coordinates": [
+			[[[8.5, 50], [8.8, 50], [8.8, 50.2], [8.5, 50.2], [8.5, 50]]]
+		]}}
+	]}`
+	if err := ioutil.WriteFile(zonesPath, []byte(zones), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		action     string
+		remoteAddr string
+		zone       string
+		status     int
+	}{
+		{remoteAddr: ValidIPAndPort, zone: "south", status: http.StatusOK},
+		{remoteAddr: "188.193.89.1:9999", zone: "", status: http.StatusOK},
+		{remoteAddr: "91.0.0.1:9999", zone: "rhine-main", status: http.StatusOK},
+		{action: mw.GeofenceAllow, remoteAddr: ValidIPAndPort, zone: "south", status: http.StatusOK},
+		{action: mw.GeofenceAllow, remoteAddr: "91.0.1.1:9999", zone: "", status: http.StatusForbidden},
+		{action: mw.GeofenceBlock, remoteAddr: "91.0.0.1:9999", zone: "rhine-main", status: http.StatusForbidden},
+		{action: mw.GeofenceBlock, remoteAddr: "188.193.89.1:9999", zone: "", status: http.StatusOK},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.GeoZonesPath = zonesPath
+		mwCfg.GeoZonesAction = tc.action
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		assertHeader(t, req, mw.ZoneHeader, tc.zone)
+		if rw.Code != tc.status {
+			t.Errorf("%s %s: status %d != %d", tc.action, tc.remoteAddr, rw.Code, tc.status)
+		}
+	}
+
+	for _, tc := range []struct {
+		path   string
+		action string
+	}{
+		{path: filepath.Join(dir, "missing.geojson")},
+		{path: dbPath},
+		{action: mw.GeofenceAllow},
+		{path: zonesPath, action: "tag"},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.GeoZonesPath, mwCfg.GeoZonesAction = tc.path, tc.action
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Errorf("expected error for geoZonesPath %s with action %s", tc.path, tc.action)
+		}
+	}
+}
+
+func TestGeoIPASNRules(t *testing.T) {
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-ASN.mmdb", "GeoLite2-ASN", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(6805), "autonomous_system_organization": "Telefonica Germany"},
+		"104.131.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(14061), "autonomous_system_organization": "DIGITALOCEAN-ASN"},
+		"3.0.0.0/8":      map[string]interface{}{"autonomous_system_number": uint32(16509), "autonomous_system_organization": "AMAZON-02"},
+	})
+
+	for _, tc := range []struct {
+		allowed    []string
+		blocked    []string
+		orgs       []string
+		remoteAddr string
+		status     int
+	}{
+		{blocked: []string{"AS14061"}, remoteAddr: "104.131.1.1:9999", status: http.StatusForbidden},
+		{blocked: []string{"AS14061"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{blocked: []string{"as16509"}, remoteAddr: "3.3.3.3:9999", status: http.StatusForbidden},
+		{allowed: []string{"6805"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+		{allowed: []string{"6805"}, remoteAddr: "3.3.3.3:9999", status: http.StatusForbidden},
+		{allowed: []string{"6805"}, remoteAddr: "1.1.1.1:9999", status: http.StatusForbidden},
+		{orgs: []string{"digitalocean", "Amazon"}, remoteAddr: "104.131.1.1:9999", status: http.StatusForbidden},
+		{orgs: []string{"digitalocean", "Amazon"}, remoteAddr: "3.3.3.3:9999", status: http.StatusForbidden},
+		{orgs: []string{"digitalocean", "Amazon"}, remoteAddr: ValidIPAndPort, status: http.StatusOK},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.AllowedASNs = tc.allowed
+		mwCfg.BlockedASNs = tc.blocked
+		mwCfg.BlockedASOrgs = tc.orgs
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status {
+			t.Errorf("%v/%v/%v %s: status %d != %d", tc.allowed, tc.blocked, tc.orgs, tc.remoteAddr, rw.Code, tc.status)
+		}
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.BlockedASNs = []string{"DigitalOcean"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an invalid AS number")
+	}
+}
+
+func TestGeoIPBlockAnonymizers(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+			"188.193.88.0/24": testCountryRecord("DE"),
+		}),
+		writeTestDB(t, dir, "GeoIP2-Anonymous-IP.mmdb", "GeoIP2-Anonymous-IP", map[string]interface{}{
+			"185.220.101.0/24": map[string]interface{}{"is_anonymous": true, "is_tor_exit_node": true},
+			"198.51.100.0/24":  map[string]interface{}{"is_anonymous": true, "is_anonymous_vpn": true, "is_hosting_provider": true},
+		}),
+	}
+	mwCfg.BlockAnonymizers = []string{"torExitNode", "hostingProvider"}
+
+	requests := []struct {
+		remoteAddr string
+		reason     string
+	}{
+		{remoteAddr: "185.220.101.5:9999", reason: "anonymizer torExitNode"},
+		{remoteAddr: "198.51.100.7:9999", reason: "anonymizer hostingProvider"},
+		{remoteAddr: ValidIPAndPort},
+	}
+	for _, action := range []string{mw.BlockActionReject, mw.BlockActionTag} {
+		mwCfg.BlockAction = action
+		called := false
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true })
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		for _, tc := range requests {
+			called = false
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set(mw.BlockedHeader, "spoofed")
+			rw := httptest.NewRecorder()
+			instance.ServeHTTP(rw, req)
+			switch {
+			case action == mw.BlockActionTag:
+				assertHeader(t, req, mw.BlockedHeader, tc.reason)
+				if !called {
+					t.Errorf("%s not passed on with the tag blockAction", tc.remoteAddr)
+				}
+			case tc.reason != "" && (rw.Code != http.StatusForbidden || called):
+				t.Errorf("%s not blocked: status %d", tc.remoteAddr, rw.Code)
+			case tc.reason == "" && !called:
+				t.Errorf("%s blocked: status %d", tc.remoteAddr, rw.Code)
+			}
+		}
+	}
+
+	mwCfg.BlockAnonymizers = []string{"tor"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an unsupported anonymizer")
+	}
+}
+
+func TestGeoIPBlockResponse(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"81.2.69.0/24": testCountryRecord("GB"),
+	})
+	mwCfg.BlockedCountries = []string{"GB"}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for _, tc := range []struct {
+		status      int
+		body        string
+		contentType string
+		blockedBy   string
+		expected    string
+		expectedCT  string
+		link        string
+	}{
+		{status: http.StatusForbidden, expected: "Forbidden\n", expectedCT: "text/plain; charset=utf-8"},
+		{status: http.StatusNotFound, expected: "Not Found\n", expectedCT: "text/plain; charset=utf-8"},
+		{status: http.StatusUnavailableForLegalReasons, body: "<h1>Unavailable</h1>", contentType: "text/html", expected: "<h1>Unavailable</h1>", expectedCT: "text/html"},
+		{
+			status: http.StatusUnavailableForLegalReasons, blockedBy: "https://authority.example/orders/42",
+			expected: "Unavailable For Legal Reasons\n", expectedCT: "text/plain; charset=utf-8",
+			link: `<https://authority.example/orders/42>; rel="blocked-by"`,
+		},
+	} {
+		mwCfg.BlockStatus = tc.status
+		mwCfg.BlockBody = tc.body
+		mwCfg.BlockContentType = tc.contentType
+		mwCfg.BlockedBy = tc.blockedBy
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "81.2.69.142:9999"
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != tc.status {
+			t.Errorf("invalid status %d != %d", rw.Code, tc.status)
+		}
+		if rw.Body.String() != tc.expected || rw.Header().Get("Content-Type") != tc.expectedCT {
+			t.Errorf("invalid response %q %q", rw.Header().Get("Content-Type"), rw.Body.String())
+		}
+		if link := rw.Header().Get(mw.LinkHeader); link != tc.link {
+			t.Errorf("invalid Link header %q != %q", link, tc.link)
+		}
+	}
+
+	mwCfg.BlockedBy = "/orders/42"
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for a relative blockedBy")
+	}
+	mwCfg.BlockedBy = ""
+	mwCfg.BlockStatus = http.StatusOK
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatal("expected error for an invalid blockStatus")
+	}
+}
+
+func TestGeoIPBlockTemplate(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		"81.2.69.0/24":    testCityRecord("GB", "England", "<London>"),
+	})
+	mwCfg.BlockedCountries = []string{"DE", "GB"}
+	mwCfg.BlockStatus = http.StatusUnavailableForLegalReasons
+	mwCfg.BlockTemplate = `<p lang="{{.Language}}">{{.City}}, {{.Country}} ({{.IP}}): {{.Rule}} {{.Status}}</p>`
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: ValidIPAndPort, expected: `<p lang="de">Munich, DE (188.193.88.199): country DE 451</p>`},
+		{remoteAddr: "81.2.69.142:9999", expected: `<p lang="de">&lt;London&gt;, GB (81.2.69.142): country GB 451</p>`},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("Accept-Language", "de")
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		if rw.Code != http.StatusUnavailableForLegalReasons {
+			t.Errorf("invalid status %d", rw.Code)
+		}
+		if rw.Body.String() != tc.expected || rw.Header().Get("Content-Type") != mw.DefaultBlockTemplateContentType {
+			t.Errorf("invalid response %q %q", rw.Header().Get("Content-Type"), rw.Body.String())
+		}
+	}
+
+	for _, tc := range []struct {
+		body string
+		tmpl string
+	}{
+		{tmpl: "{{.City"},
+		{body: "Blocked", tmpl: "{{.City}}"},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.BlockBody, mwCfg.BlockTemplate = tc.body, tc.tmpl
+		if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Errorf("expected error for blockTemplate %q with blockBody %q", tc.tmpl, tc.body)
+		}
+	}
+}
+
+func TestGeoIPBlockRedirect(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"81.2.69.0/24": testCityRecord("GB", "England", "St Albans"),
+	})
+	mwCfg.BlockedCountries = []string{"GB"}
+	mwCfg.BlockAction = mw.BlockActionRedirect
+	mwCfg.BlockRedirectURL = "https://example.com/unavailable?c={{.Country}}&city={{.City | query}}"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.142:9999"
+	rw := httptest.NewRecorder()
+	instance.ServeHTTP(rw, req)
+	if rw.Code != http.StatusFound {
+		t.Errorf("invalid status %d", rw.Code)
+	}
+	if location := rw.Header().Get("Location"); location != "https://example.com/unavailable?c=GB&city=St+Albans" {
+		t.Errorf("invalid location %q", location)
+	}
+
+	for _, tc := range []struct {
+		action string
+		url    string
+	}{
+		{action: mw.BlockActionRedirect},
+		{action: mw.BlockActionRedirect, url: "https://example.com/{{.Country"},
+		{action: "drop"},
+	} {
+		mwCfg.BlockAction, mwCfg.BlockRedirectURL = tc.action, tc.url
+		if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Errorf("expected error for blockAction %s %q", tc.action, tc.url)
+		}
+	}
+}
+
+// TestGeoIPTemplatesSmoke runs every template path in one instance; the
+// yaegi_test target runs it under the interpreter Traefik loads plugins with.
+func TestGeoIPTemplatesSmoke(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		"81.2.69.0/24":    testCityRecord("GB", "England", "London"),
+	})
+	mwCfg.BlockedCountries = []string{"GB"}
+	mwCfg.CustomHeaders = map[string]string{"X-Geo": `{{.Country}}/{{index . "City"}}`}
+	mwCfg.BlockTemplate = "{{.Country}} {{.City}} {{.Rule}} {{.Status}}"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Geo", "DE/Munich")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.142:9999"
+	rw := httptest.NewRecorder()
+	instance.ServeHTTP(rw, req)
+	if rw.Body.String() != "GB London country GB 403" {
+		t.Errorf("invalid block page %q", rw.Body.String())
+	}
+
+	mwCfg.BlockAction = mw.BlockActionRedirect
+	mwCfg.BlockRedirectURL = "https://example.com/{{.Country}}"
+	instance, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	rw = httptest.NewRecorder()
+	instance.ServeHTTP(rw, req)
+	if location := rw.Header().Get("Location"); location != "https://example.com/GB" {
+		t.Errorf("invalid location %q", location)
+	}
+}
+
+func TestGeoIPStripClientHeaders(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.Headers.City = "X-Town"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	req.Header.Set("X-GeoIP2-Is-Trusted", "true")
+	req.Header.Set("x-geoip2-country-code", "US")
+	req.Header.Set("X-Town", "Berlin")
+	req.Header.Set("X-Other", "kept")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-GeoIP2-Is-Trusted", "")
+	assertHeader(t, req, "X-GeoIP2-Country-Code", "")
+	assertHeader(t, req, "X-Town", "Munich")
+	assertHeader(t, req, "X-Other", "kept")
+}
+
+func TestGeoIPASN(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		writeTestDB(t, dir, "GeoLite2-ASN.mmdb", "GeoLite2-ASN", map[string]interface{}{
+			"188.193.0.0/16": map[string]interface{}{
+				"autonomous_system_number":       uint32(6805),
+				"autonomous_system_organization": "Telefonica Germany",
+			},
+		}),
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.ASNHeader, "6805")
+	assertHeader(t, req, mw.ASOrgHeader, "Telefonica Germany")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "1.1.1.1:9999"
+	req.Header.Set(mw.ASNHeader, "1234")
+	req.Header.Set(mw.ASOrgHeader, "Spoofed")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+	assertHeader(t, req, mw.ASNHeader, "")
+	assertHeader(t, req, mw.ASOrgHeader, "")
+}
+
+func TestGeoIPAnonymousIP(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+			"188.193.88.0/24": testCountryRecord("DE"),
+		}),
+		writeTestDB(t, dir, "GeoIP2-Anonymous-IP.mmdb", "GeoIP2-Anonymous-IP", map[string]interface{}{
+			"185.220.101.0/24": map[string]interface{}{
+				"is_anonymous":     true,
+				"is_tor_exit_node": true,
+			},
+		}),
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "185.220.101.5:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.IsAnonymousHeader, "true")
+	assertHeader(t, req, mw.IsTorExitHeader, "true")
+	assertHeader(t, req, mw.IsVPNHeader, "false")
+	assertHeader(t, req, mw.IsHostingHeader, "false")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.IsAnonymousHeader, "false")
+	assertHeader(t, req, mw.IsTorExitHeader, "false")
+}
+
+func TestGeoIPISP(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoIP2-ISP.mmdb", "GeoIP2-ISP", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"autonomous_system_number":       uint32(6805),
+			"autonomous_system_organization": "Telefonica Germany",
+			"isp":                            "Telefonica Germany",
+			"organization":                   "O2 Online",
+		},
+		"81.2.69.0/24": map[string]interface{}{
+			"autonomous_system_number": uint32(20712),
+			"isp":                      "EE",
+			"mobile_country_code":      "234",
+			"mobile_network_code":      "30",
+		},
+	})
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+	assertHeader(t, req, mw.ASNHeader, "6805")
+	assertHeader(t, req, mw.ISPHeader, "Telefonica Germany")
+	assertHeader(t, req, mw.OrganizationHeader, "O2 Online")
+	assertHeader(t, req, mw.MCCHeader, "")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "81.2.69.142:9999"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.ASNHeader, "20712")
+	assertHeader(t, req, mw.ISPHeader, "EE")
+	assertHeader(t, req, mw.MCCHeader, "234")
+	assertHeader(t, req, mw.MNCHeader, "30")
+}
+
+func TestGeoIPConnectionType(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoIP2-Connection-Type.mmdb", "GeoIP2-Connection-Type", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{"connection_type": "Cellular"},
+	})
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.ConnectionTypeHeader, "Cellular")
+}
+
+func TestGeoIPEnterprise(t *testing.T) {
+	record := testCityRecord("DE", "Bavaria", "Munich")
+	record["country"].(map[string]interface{})["confidence"] = uint16(99)
+	record["city"].(map[string]interface{})["confidence"] = uint16(60)
+	record["subdivisions"].([]interface{})[0].(map[string]interface{})["confidence"] = uint16(80)
+	record["traits"] = map[string]interface{}{
+		"autonomous_system_number": uint32(6805),
+		"isp":                      "Telefonica Germany",
+		"connection_type":          "Cable/DSL",
+		"user_type":                "residential",
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoIP2-Enterprise.mmdb", "GeoIP2-Enterprise", map[string]interface{}{
+		"188.193.88.0/24": record,
+	})
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+	assertHeader(t, req, mw.CountryConfidenceHeader, "99")
+	assertHeader(t, req, mw.RegionConfidenceHeader, "80")
+	assertHeader(t, req, mw.CityConfidenceHeader, "60")
+	assertHeader(t, req, mw.UserTypeHeader, "residential")
+	assertHeader(t, req, mw.ASNHeader, "6805")
+	assertHeader(t, req, mw.ISPHeader, "Telefonica Germany")
+	assertHeader(t, req, mw.ConnectionTypeHeader, "Cable/DSL")
+}
+
+func TestGeoIPDBType(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "geo.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.DBType = mw.DBTypeCity
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	mwCfg.DBType = "weather"
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid dbType")
+	}
+}
+
+func TestGeoIPChecksum(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.FailOnError = true
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+	})
+	content, err := ioutil.ReadFile(mwCfg.DBPath)
+	if err != nil {
+		t.Fatalf("Unable to read DB: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	mwCfg.DBChecksum = checksum
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err != nil {
+		t.Fatalf("Must not fail on matching checksum: %v", err)
+	}
+
+	mwCfg.DBChecksum = strings.Repeat("0", 64)
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on checksum mismatch")
+	}
+
+	mwCfg.DBChecksum = ""
+	sidecar := []byte(checksum + "  GeoLite2-Country.mmdb\n")
+	if err := ioutil.WriteFile(mwCfg.DBPath+".sha256", sidecar, 0o600); err != nil {
+		t.Fatalf("Unable to write checksum: %v", err)
+	}
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err != nil {
+		t.Fatalf("Must not fail on matching sidecar checksum: %v", err)
+	}
+
+	// Instances share an open database, use another copy to have it verified again.
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-Country.mmdb", "GeoLite2-Country", map[string]interface{}{
+		"188.193.88.0/24": testCountryRecord("DE"),
+	})
+	if err := ioutil.WriteFile(mwCfg.DBPath+".sha256", []byte(strings.Repeat("0", 64)), 0o600); err != nil {
+		t.Fatalf("Unable to write checksum: %v", err)
+	}
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on sidecar checksum mismatch")
+	}
+}
+
+func TestGeoIPDBIP(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "dbip-city-lite-2020-01.mmdb", "DBIP-City-Lite", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		writeTestDB(t, dir, "dbip-asn-lite-2020-01.mmdb", "DBIP-ASN-Lite", map[string]interface{}{
+			"188.193.0.0/16": map[string]interface{}{
+				"autonomous_system_number":       uint32(6805),
+				"autonomous_system_organization": "Telefonica Germany",
+			},
+		}),
+	}
+	mwCfg.FailOnError = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+	assertHeader(t, req, mw.ASNHeader, "6805")
+}
+
+func TestGeoIPIP2Location(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestIP2LocationDB(t, t.TempDir(), "IP2LOCATION-LITE-DB3.BIN", map[string][3]string{
+		"0.0.0.0":      {"-", "-", "-"},
+		"188.193.88.0": {"DE", "Bayern", "Munich"},
+		"188.193.89.0": {"-", "-", "-"},
+	})
+	mwCfg.FailOnError = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, "DE")
+	assertHeader(t, req, mw.RegionHeader, "Bayern")
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "188.193.89.1:1234"
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+}
+
+func TestGeoIPCustomFields(t *testing.T) {
+	dir := t.TempDir()
+	city := testCityRecord("DE", "Bavaria", "Munich")
+	city["location"] = map[string]interface{}{"time_zone": "Europe/Berlin"}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": city,
+		}),
+		writeTestDB(t, dir, "acme.mmdb", "Acme-Internal", map[string]interface{}{
+			"188.193.88.0/24": map[string]interface{}{
+				"department": "sales",
+				"site":       map[string]interface{}{"id": uint32(7), "primary": true},
+				"tags":       []interface{}{"office", "vpn"},
+			},
+		}),
+	}
+	mwCfg.Fields = map[string]string{
+		"location.time_zone": "X-Time-Zone",
+		"department":         "X-Department",
+		"site.id":            "X-Site",
+		"site.primary":       "X-Site-Primary",
+		"tags.1":             "X-Tag",
+	}
+	mwCfg.FailOnError = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+	assertHeader(t, req, "X-Time-Zone", "Europe/Berlin")
+	assertHeader(t, req, "X-Department", "sales")
+	assertHeader(t, req, "X-Site", "7")
+	assertHeader(t, req, "X-Site-Primary", "true")
+	assertHeader(t, req, "X-Tag", "vpn")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "8.8.8.8:1234"
+	req.Header.Set("X-Department", "spoofed")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Department", "")
+
+	mwCfg = mw.CreateConfig()
+	mwCfg.DBType = mw.DBTypeCustom
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on custom dbType without fields")
+	}
+}
+
+func TestGeoIPCustomFieldsInvalidData(t *testing.T) {
+	deep := map[string]interface{}{"department": "sales"}
+	for i := 0; i < 600; i++ {
+		deep = map[string]interface{}{"a": deep}
+	}
+	// Each level of the record is an array of 16 pointers to the level before it, which is
+	// 16^20 values from less than a kilobyte of data.
+	fanOut := []interface{}{[]interface{}{"x"}}
+	previous, offset := 2, 2+len(encodeTestValue(fanOut[0]))
+	for level := 0; level < 20; level++ {
+		pointers := make([]interface{}, 16)
+		for i := range pointers {
+			pointers[i] = testPointer(previous)
+		}
+		fanOut = append(fanOut, pointers)
+		previous, offset = offset, offset+len(encodeTestValue(pointers))
+	}
+	for name, record := range map[string]interface{}{
+		// The first record is at offset 0 of the data section, it points to itself.
+		"pointer to pointer": testPointer(0),
+		"deep nesting":       deep,
+		"fan-out pointers":   fanOut,
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = writeTestDB(t, t.TempDir(), "acme.mmdb", "Acme-Internal", map[string]interface{}{
+			"188.193.88.0/24": record,
+		})
+		mwCfg.Fields = map[string]string{"department": "X-Department"}
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("%s: error creating %v", name, err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		done := make(chan struct{})
+		go func() {
+			instance.ServeHTTP(httptest.NewRecorder(), req)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: lookup did not finish", name)
+		}
+		assertHeader(t, req, "X-Department", "")
+	}
+}
+
+func TestGeoIPMaxDBAge(t *testing.T) {
+	// writeTestDB builds databases dated September 2020.
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for maxDBAge, expected := range map[string]string{"1080h": "true", "": ""} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		mwCfg.MaxDBAge = maxDBAge
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		req.Header.Set(mw.StaleHeader, "spoofed")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.StaleHeader, expected)
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.MaxDBAge = "45 days"
+	if _, err := mw.New(context.TODO(), next, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on invalid maxDbAge")
+	}
+}
+
+func TestGeoIPDebugHeader(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPaths = []string{
+		writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+			"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+		}),
+		dir + "/GeoLite2-ASN.mmdb",
+	}
+	mwCfg.DebugHeader = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(rw, req)
+
+	info := rw.Header().Values(mw.DBInfoHeader)
+	expected := []string{
+		mwCfg.DBPaths[0] + "; type=GeoLite2-City; built=2020-09-13T12:26:40Z; nodes=",
+		mwCfg.DBPaths[1] + "; not loaded",
+	}
+	if len(info) != 2 || !strings.HasPrefix(info[0], expected[0]) || info[1] != expected[1] {
+		t.Fatalf("invalid value of header [%s] %q", mw.DBInfoHeader, info)
+	}
+	if _, err := strconv.ParseUint(rw.Header().Get(mw.DurationHeader), 10, 64); err != nil {
+		t.Fatalf("invalid value of header [%s] %q", mw.DurationHeader, rw.Header().Get(mw.DurationHeader))
+	}
+}
+
+func TestGeoIPArchive(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	content, err := ioutil.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Unable to read DB: %v", err)
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(content)
+	_ = w.Close()
+
+	archives := map[string][]byte{
+		"GeoLite2-City_20200101.tar.gz": testArchive(t, dbPath),
+		"GeoLite2-City.mmdb.gz":         gz.Bytes(),
+	}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	for name, archive := range archives {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = filepath.Join(dir, name)
+		mwCfg.DownloadDir = t.TempDir()
+		mwCfg.FailOnError = true
+		if err := ioutil.WriteFile(mwCfg.DBPath, archive, 0o600); err != nil {
+			t.Fatalf("Unable to write archive: %v", err)
+		}
+
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("Error creating %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CityHeader, "Munich")
+	}
+}
+
+func TestGeoIPDBMode(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	if mwCfg.DBMode != mw.DBModeMemory {
+		t.Fatalf("Incorrect default dbMode")
+	}
+
+	mwCfg.DBMode = "disk"
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on invalid dbMode")
+	}
+}
+
 func assertHeader(t *testing.T, req *http.Request, key, expected string) {
 	t.Helper()
 	if req.Header.Get(key) != expected {
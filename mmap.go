@@ -0,0 +1,48 @@
+//go:build geoip2mmap && (linux || darwin || freebsd || netbsd || openbsd)
+// +build geoip2mmap
+// +build linux darwin freebsd netbsd openbsd
+
+package traefikgeoip2
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// mmapSupported reports whether dbMode mmap is available in this build.
+const mmapSupported = true
+
+// mappedFile is a read-only memory mapping of a database file.
+type mappedFile struct {
+	data []byte
+}
+
+// mapFile maps the file at path into memory. The mapping is released when
+// the returned value is garbage collected.
+func mapFile(path string) (*mappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("database `%s' is empty", path)
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	mapping := &mappedFile{data: data}
+	runtime.SetFinalizer(mapping, func(m *mappedFile) {
+		_ = syscall.Munmap(m.data)
+	})
+	return mapping, nil
+}
@@ -0,0 +1,20 @@
+//go:build !geoip2mmap || !(linux || darwin || freebsd || netbsd || openbsd)
+// +build !geoip2mmap !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package traefikgeoip2
+
+import "errors"
+
+// mmapSupported reports whether dbMode mmap is available in this build.
+// Traefik loads plugins with yaegi, which has no syscall package, so memory
+// mapping is only compiled in with the geoip2mmap build tag.
+const mmapSupported = false
+
+// mappedFile is a read-only memory mapping of a database file.
+type mappedFile struct {
+	data []byte
+}
+
+func mapFile(path string) (*mappedFile, error) {
+	return nil, errors.New("dbMode mmap requires a build with the geoip2mmap tag")
+}
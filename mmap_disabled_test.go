@@ -0,0 +1,19 @@
+//go:build !geoip2mmap || !(linux || darwin || freebsd || netbsd || openbsd)
+// +build !geoip2mmap !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package traefikgeoip2_test
+
+import (
+	"context"
+	"testing"
+
+	mw "github.com/sopov/traefikgeoip2"
+)
+
+func TestGeoIPMmapUnsupported(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBMode = mw.DBModeMmap
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on dbMode mmap without the geoip2mmap tag")
+	}
+}
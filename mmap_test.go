@@ -0,0 +1,33 @@
+//go:build geoip2mmap && (linux || darwin || freebsd || netbsd || openbsd)
+// +build geoip2mmap
+// +build linux darwin freebsd netbsd openbsd
+
+package traefikgeoip2_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mw "github.com/sopov/traefikgeoip2"
+)
+
+func TestGeoIPMmap(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.DBMode = mw.DBModeMmap
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
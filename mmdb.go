@@ -0,0 +1,591 @@
+package traefikgeoip2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/IncSW/geoip2"
+)
+
+// MaxMind DB data section types.
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBInvalid = errors.New("invalid MaxMind DB data")
+
+// mmdbMaxDepth the maximum nesting of maps and arrays, as of libmaxminddb.
+const mmdbMaxDepth = 512
+
+// mmdbMaxValues the maximum number of values decoded by a decode call. Pointers let values
+// share data, so a small crafted database can hold records of exponential size.
+const mmdbMaxValues = 1 << 16
+
+// mmdbDecoder decodes values of the MaxMind DB data format into
+// map[string]interface{}, []interface{}, string, float64, uint64, int32, bool, []byte and *big.Int.
+type mmdbDecoder struct {
+	buffer []byte
+}
+
+// decode decodes the value at offset and returns it with the offset following it.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	budget := mmdbMaxValues
+	return d.decodeAt(offset, 0, &budget)
+}
+
+// decodeAt decodes the value at offset nested in depth maps and arrays, taking it from the
+// budget of values left. Pointers must not point to pointers, so a crafted database cannot
+// make the decoder loop.
+func (d *mmdbDecoder) decodeAt(offset uint, depth int, budget *int) (interface{}, uint, error) {
+	if *budget--; *budget < 0 {
+		return nil, 0, errMMDBInvalid
+	}
+	dataType, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dataType != mmdbPointer {
+		return d.decodeValue(dataType, size, offset, depth, budget)
+	}
+	pointer, next, err := d.pointer(size, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dataType, size, offset, err = d.control(pointer); err != nil {
+		return nil, 0, err
+	}
+	if dataType == mmdbPointer {
+		return nil, 0, errMMDBInvalid
+	}
+	value, _, err := d.decodeValue(dataType, size, offset, depth, budget)
+	return value, next, err
+}
+
+func (d *mmdbDecoder) decodeValue(dataType byte, size, offset uint, depth int, budget *int) (interface{}, uint, error) {
+	// Every entry takes at least a byte, so a size beyond the buffer cannot allocate.
+	if (dataType == mmdbMap || dataType == mmdbArray) && (depth >= mmdbMaxDepth || size > uint(len(d.buffer))-offset) {
+		return nil, 0, errMMDBInvalid
+	}
+	switch dataType {
+	case mmdbMap:
+		return d.decodeMap(size, offset, depth+1, budget)
+	case mmdbArray:
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decodeAt(offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	end := offset + size
+	if end > uint(len(d.buffer)) {
+		return nil, 0, errMMDBInvalid
+	}
+	raw := d.buffer[offset:end]
+	switch dataType {
+	case mmdbString:
+		return string(raw), end, nil
+	case mmdbBytes:
+		return append([]byte(nil), raw...), end, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), end, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), end, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		return decodeUint(raw), end, nil
+	case mmdbInt32:
+		return int32(uint32(decodeUint(raw))), end, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(raw), end, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", dataType)
+}
+
+func (d *mmdbDecoder) decodeMap(size, offset uint, depth int, budget *int) (interface{}, uint, error) {
+	values := make(map[string]interface{}, size)
+	for i := uint(0); i < size; i++ {
+		key, next, err := d.decodeAt(offset, depth, budget)
+		if err != nil {
+			return nil, 0, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, 0, errMMDBInvalid
+		}
+		value, next, err := d.decodeAt(next, depth, budget)
+		if err != nil {
+			return nil, 0, err
+		}
+		values[name] = value
+		offset = next
+	}
+	return values, offset, nil
+}
+
+// control reads the control byte at offset and returns the data type, its size
+// and the offset of the payload.
+func (d *mmdbDecoder) control(offset uint) (byte, uint, uint, error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errMMDBInvalid
+	}
+	ctrl := d.buffer[offset]
+	offset++
+	dataType := ctrl >> 5
+	if dataType == mmdbExtended {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errMMDBInvalid
+		}
+		dataType = 7 + d.buffer[offset]
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if dataType == mmdbPointer || size < 29 {
+		return dataType, size, offset, nil
+	}
+
+	extra := size - 28
+	if offset+extra > uint(len(d.buffer)) {
+		return 0, 0, 0, errMMDBInvalid
+	}
+	value := uint(decodeUint(d.buffer[offset : offset+extra]))
+	switch extra {
+	case 1:
+		size = 29 + value
+	case 2:
+		size = 285 + value
+	default:
+		size = 65821 + value
+	}
+	return dataType, size, offset + extra, nil
+}
+
+// pointer resolves the pointer with the size bits of its control byte.
+func (d *mmdbDecoder) pointer(size, offset uint) (uint, uint, error) {
+	length := ((size >> 3) & 0x3) + 1
+	if offset+length > uint(len(d.buffer)) {
+		return 0, 0, errMMDBInvalid
+	}
+	prefix := uint64(0)
+	if length != 4 {
+		prefix = uint64(size & 0x7)
+	}
+	pointer := uint(prefix<<(8*length) | decodeUint(d.buffer[offset:offset+length]))
+	switch length {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, offset + length, nil
+}
+
+func decodeUint(raw []byte) uint64 {
+	var value uint64
+	for _, b := range raw {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// mmdbMetadataStart returns the offset of the metadata map in buffer.
+func mmdbMetadataStart(buffer []byte) (int, error) {
+	start := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if start < 0 {
+		return 0, errors.New("MaxMind DB metadata not found")
+	}
+	return start + len(mmdbMetadataMarker), nil
+}
+
+// readMetadata decodes the metadata map of the database in buffer.
+func readMetadata(buffer []byte) (map[string]interface{}, error) {
+	start, err := mmdbMetadataStart(buffer)
+	if err != nil {
+		return nil, err
+	}
+	decoder := &mmdbDecoder{buffer: buffer[start:]}
+	value, _, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBInvalid
+	}
+	return metadata, nil
+}
+
+// retypeDatabase returns a copy of buffer with the database_type metadata set to dbType.
+// The metadata section is the last part of the file and is not referenced from the
+// search tree or data section, so its entries can be resized in place.
+func retypeDatabase(buffer []byte, dbType string) ([]byte, error) {
+	start, err := mmdbMetadataStart(buffer)
+	if err != nil {
+		return nil, err
+	}
+	decoder := &mmdbDecoder{buffer: buffer[start:]}
+	dataType, size, offset, err := decoder.control(0)
+	if err != nil {
+		return nil, err
+	}
+	if dataType != mmdbMap {
+		return nil, errMMDBInvalid
+	}
+
+	for i := uint(0); i < size; i++ {
+		key, valueStart, err := decoder.decode(offset)
+		if err != nil {
+			return nil, err
+		}
+		_, valueEnd, err := decoder.decode(valueStart)
+		if err != nil {
+			return nil, err
+		}
+		if key != "database_type" {
+			offset = valueEnd
+			continue
+		}
+		if len(dbType) >= 29 {
+			return nil, errors.New("database type too long")
+		}
+
+		retyped := make([]byte, 0, len(buffer)+len(dbType))
+		retyped = append(retyped, buffer[:start+int(valueStart)]...)
+		retyped = append(retyped, byte(mmdbString<<5|len(dbType)))
+		retyped = append(retyped, dbType...)
+		retyped = append(retyped, buffer[start+int(valueEnd):]...)
+		return retyped, nil
+	}
+	return nil, errors.New("MaxMind DB metadata has no database_type")
+}
+
+// mmdbReader looks up records in the search tree of a MaxMind DB of any type.
+type mmdbReader struct {
+	tree       []byte
+	decoder    *mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// newMMDBReader creates a generic reader over the database in buffer.
+func newMMDBReader(buffer []byte) (*mmdbReader, error) {
+	metadata, err := readMetadata(buffer)
+	if err != nil {
+		return nil, err
+	}
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", recordSize)
+	}
+
+	treeSize := uint(nodeCount) * uint(recordSize) / 4
+	dataEnd := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if treeSize+16 > uint(dataEnd) {
+		return nil, errMMDBInvalid
+	}
+	rdr := &mmdbReader{
+		tree:       buffer[:treeSize],
+		decoder:    &mmdbDecoder{buffer: buffer[treeSize+16 : dataEnd]},
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	if rdr.ipVersion == 6 {
+		for i := 0; i < 96 && rdr.ipv4Start < rdr.nodeCount; i++ {
+			rdr.ipv4Start = rdr.readNode(rdr.ipv4Start, 0)
+		}
+	}
+	return rdr, nil
+}
+
+// readNode returns the record of the left (0) or right (1) branch of node.
+func (rdr *mmdbReader) readNode(node, bit uint) uint {
+	switch rdr.recordSize {
+	case 24:
+		return uint(decodeUint(rdr.tree[node*6+bit*3 : node*6+bit*3+3]))
+	case 28:
+		raw := rdr.tree[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(raw[3]&0xf0)<<20 | uint(decodeUint(raw[:3]))
+		}
+		return uint(raw[3]&0x0f)<<24 | uint(decodeUint(raw[4:]))
+	}
+	return uint(decodeUint(rdr.tree[node*8+bit*4 : node*8+bit*4+4]))
+}
+
+// lookup returns the decoded record of the network containing ip.
+func (rdr *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node, _, err := rdr.find(ip)
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := rdr.decoder.decode(node - rdr.nodeCount - 16)
+	return record, err
+}
+
+// network returns the network of the search tree containing ip, e.g. 81.2.69.0/24.
+func (rdr *mmdbReader) network(ip net.IP) (*net.IPNet, error) {
+	_, network, err := rdr.find(ip)
+	return network, err
+}
+
+// find walks the search tree to the data record of ip and returns its pointer with the
+// network it covers.
+func (rdr *mmdbReader) find(ip net.IP) (uint, *net.IPNet, error) {
+	key, node := []byte(ip.To4()), rdr.ipv4Start
+	if key == nil {
+		if rdr.ipVersion != 6 {
+			return 0, nil, geoip2.ErrNotFound
+		}
+		key, node = []byte(ip.To16()), 0
+	}
+	if key == nil {
+		return 0, nil, fmt.Errorf("invalid IP address `%s'", ip)
+	}
+
+	bits := uint(len(key)) * 8
+	prefix := uint(0)
+	for ; prefix < bits && node < rdr.nodeCount; prefix++ {
+		node = rdr.readNode(node, uint(key[prefix/8]>>(7-prefix%8))&1)
+	}
+	switch {
+	case node == rdr.nodeCount:
+		return 0, nil, geoip2.ErrNotFound
+	case node < rdr.nodeCount:
+		return 0, nil, errMMDBInvalid
+	}
+	mask := net.CIDRMask(int(prefix), int(bits))
+	return node, &net.IPNet{IP: net.IP(key).Mask(mask), Mask: mask}, nil
+}
+
+// createNetworkLookup adds the network of the search tree the address is in to the
+// results of lookup.
+func createNetworkLookup(lookup LookupGeoIP2, rdr *mmdbReader) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		retval, err := lookup(ip)
+		if err != nil {
+			return nil, err
+		}
+		if network, err := rdr.network(ip); err == nil {
+			retval.network = network.String()
+		}
+		return retval, nil
+	}
+}
+
+// createFieldsLookup adds the configured record fields to the results of lookup,
+// which is nil for custom databases. Fields maps record paths to header names.
+func createFieldsLookup(lookup LookupGeoIP2, rdr *mmdbReader, fields map[string]string) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		record, err := rdr.lookup(ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		retval := &GeoIPResult{}
+		if lookup != nil {
+			if retval, err = lookup(ip); err != nil {
+				return nil, err
+			}
+		}
+		retval.fields = make(map[string]string, len(fields))
+		for path, header := range fields {
+			if value := recordValue(record, path); value != "" {
+				retval.fields[header] = value
+			}
+		}
+		return retval, nil
+	}
+}
+
+// recordValue formats the value at the dot separated path in record, e.g. `subdivisions.0.iso_code'.
+// It returns an empty string when the path does not lead to a scalar value.
+func recordValue(record interface{}, path string) string {
+	switch v := recordAt(record, path).(type) {
+	case string:
+		return v
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case *big.Int:
+		return v.String()
+	}
+	return ""
+}
+
+// recordAt returns the value at the dot separated path in record, nil when there is none.
+func recordAt(record interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		switch v := record.(type) {
+		case map[string]interface{}:
+			record = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			record = v[i]
+		default:
+			return nil
+		}
+	}
+	return record
+}
+
+// createRecordLookup decodes the records lookup fails on with the generic reader and
+// builds their results with build. The readers reject records with keys they do not know,
+// like the is_anycast trait of newer builds or the mobile codes of ISP records, which
+// would otherwise make the whole lookup fail.
+func createRecordLookup(lookup LookupGeoIP2, rdr *mmdbReader, build func(interface{}) GeoIPResult) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		retval, err := lookup(ip)
+		if err == nil || errors.Is(err, geoip2.ErrNotFound) {
+			return retval, err
+		}
+		record, decodeErr := rdr.lookup(ip)
+		if decodeErr != nil {
+			return nil, err
+		}
+		result := build(record)
+		return &result, nil
+	}
+}
+
+// newRecordResult builds the result of a decoded City, Country or Enterprise record with its
+// parts.
+func newRecordResult(record interface{}, parts recordParts) GeoIPResult {
+	retval := GeoIPResult{
+		continent:         recordValue(record, "continent.code"),
+		country:           recordValue(record, "country.iso_code"),
+		registered:        recordValue(record, "registered_country.iso_code"),
+		represented:       recordValue(record, "represented_country.iso_code"),
+		region:            Unknown,
+		asn:               uint32(recordUint(record, "traits.autonomous_system_number")),
+		asOrg:             recordValue(record, "traits.autonomous_system_organization"),
+		isp:               recordValue(record, "traits.isp"),
+		organization:      recordValue(record, "traits.organization"),
+		connectionType:    recordValue(record, "traits.connection_type"),
+		userType:          recordValue(record, "traits.user_type"),
+		mcc:               recordValue(record, "traits.mobile_country_code"),
+		mnc:               recordValue(record, "traits.mobile_network_code"),
+		countryConfidence: uint16(recordUint(record, "country.confidence")),
+		regionConfidence:  uint16(recordUint(record, "subdivisions.0.confidence")),
+		cityConfidence:    uint16(recordUint(record, "city.confidence")),
+		names:             &placeNames{country: recordNames(record, "country.names")},
+		traits: &traitFlags{
+			anonymousProxy:    recordValue(record, "traits.is_anonymous_proxy") == "true",
+			satelliteProvider: recordValue(record, "traits.is_satellite_provider") == "true",
+			anycast:           recordValue(record, "traits.is_anycast") == "true",
+		},
+	}
+	if location, ok := recordAt(record, "location").(map[string]interface{}); ok {
+		latitude, _ := location["latitude"].(float64)
+		longitude, _ := location["longitude"].(float64)
+		retval.location = &geoip2.Location{
+			Latitude:       latitude,
+			Longitude:      longitude,
+			TimeZone:       recordValue(location, "time_zone"),
+			AccuracyRadius: uint16(recordUint(location, "accuracy_radius")),
+			MetroCode:      uint16(recordUint(location, "metro_code")),
+		}
+	}
+	if parts.city {
+		retval.city = recordValue(record, "city.names.en")
+		retval.names.city = recordNames(record, "city.names")
+	}
+	if !parts.region {
+		return retval
+	}
+	retval.names.region = recordNames(record, "subdivisions.0.names")
+	if recordAt(record, "subdivisions.0") != nil {
+		retval.region = recordValue(record, "subdivisions.0.names.en")
+		retval.regionCode = subdivisionCode(retval.country, geoip2.Subdivision{ISOCode: recordValue(record, "subdivisions.0.iso_code")})
+	}
+	if recordAt(record, "subdivisions.1") != nil {
+		retval.region2 = recordValue(record, "subdivisions.1.names.en")
+		retval.region2Code = subdivisionCode(retval.country, geoip2.Subdivision{ISOCode: recordValue(record, "subdivisions.1.iso_code")})
+	}
+	subdivisions, _ := recordAt(record, "subdivisions").([]interface{})
+	for _, subdivision := range subdivisions {
+		retval.subdivisions = append(retval.subdivisions, recordValue(subdivision, "names.en"))
+		retval.subdivisionCodes = append(retval.subdivisionCodes, subdivisionCode(retval.country, geoip2.Subdivision{ISOCode: recordValue(subdivision, "iso_code")}))
+	}
+	return retval
+}
+
+// newISPRecordResult builds the result of a decoded ISP record.
+func newISPRecordResult(record interface{}) GeoIPResult {
+	return GeoIPResult{
+		asn:          uint32(recordUint(record, "autonomous_system_number")),
+		asOrg:        recordValue(record, "autonomous_system_organization"),
+		isp:          recordValue(record, "isp"),
+		organization: recordValue(record, "organization"),
+		mcc:          recordValue(record, "mobile_country_code"),
+		mnc:          recordValue(record, "mobile_network_code"),
+	}
+}
+
+// recordUint returns the unsigned integer at path in record, 0 when there is none.
+func recordUint(record interface{}, path string) uint64 {
+	value, _ := recordAt(record, path).(uint64)
+	return value
+}
+
+// recordNames returns the names by locale at path in record.
+func recordNames(record interface{}, path string) map[string]string {
+	values, ok := recordAt(record, path).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	names := make(map[string]string, len(values))
+	for locale, name := range values {
+		if name, ok := name.(string); ok {
+			names[locale] = name
+		}
+	}
+	return names
+}
@@ -0,0 +1,128 @@
+package traefikgeoip2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// isObjectStore reports whether dbPath is an s3://, gs:// or azblob:// URL.
+func isObjectStore(dbPath string) bool {
+	return strings.HasPrefix(dbPath, "s3://") || strings.HasPrefix(dbPath, "gs://") || strings.HasPrefix(dbPath, "azblob://")
+}
+
+// objectStoreRequest returns the HTTPS URL of the object rawURL points to and the
+// function authorizing requests for it.
+//
+//	s3://bucket/key                 with s3AccessKeyId and s3SecretAccessKey or AWS_* variables
+//	gs://bucket/object              with gcsAccessToken or GOOGLE_OAUTH_ACCESS_TOKEN
+//	azblob://account/container/blob with azureSasToken or AZURE_STORAGE_SAS_TOKEN
+func objectStoreRequest(cfg *Config, rawURL string) (string, func(*http.Request)) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL, nil
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "s3":
+		region := firstNonEmpty(cfg.S3Region, os.Getenv("AWS_REGION"), DefaultS3Region)
+		endpoint := "https://" + u.Host + ".s3." + region + ".amazonaws.com/" + key
+		if cfg.S3Endpoint != "" {
+			endpoint = strings.TrimSuffix(cfg.S3Endpoint, "/") + "/" + u.Host + "/" + key
+		}
+		creds := awsCredentials{
+			accessKeyID:     firstNonEmpty(cfg.S3AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+			secretAccessKey: firstNonEmpty(cfg.S3SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			sessionToken:    firstNonEmpty(cfg.S3SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+			region:          region,
+		}
+		if creds.accessKeyID == "" {
+			return endpoint, nil
+		}
+		return endpoint, creds.sign
+	case "gs":
+		token := firstNonEmpty(cfg.GCSAccessToken, os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"))
+		endpoint := "https://storage.googleapis.com/" + u.Host + "/" + key
+		if token == "" {
+			return endpoint, nil
+		}
+		return endpoint, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	case "azblob":
+		sas := strings.TrimPrefix(firstNonEmpty(cfg.AzureSASToken, os.Getenv("AZURE_STORAGE_SAS_TOKEN")), "?")
+		return "https://" + u.Host + ".blob.core.windows.net/" + key, func(req *http.Request) {
+			// The token is added here rather than to the URL to keep it out of the logs.
+			req.URL.RawQuery = sas
+			req.Header.Set("x-ms-version", "2020-10-02")
+		}
+	}
+	return rawURL, nil
+}
+
+// awsCredentials signs S3 requests with AWS Signature Version 4.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+}
+
+func (c awsCredentials) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	headers := []string{"host:" + req.URL.Host, "x-amz-content-sha256:" + emptyPayloadHash, "x-amz-date:" + amzDate}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+		headers = append(headers, "x-amz-security-token:"+c.sessionToken)
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		strings.Join(headers, "\n") + "\n",
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{now.Format("20060102"), c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,603 @@
+package traefikgeoip2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/IncSW/geoip2"
+)
+
+// contextKey is the type of context keys of the plugin, a pointer so that keys do not
+// collide with those of other packages.
+type contextKey struct {
+	name string
+}
+
+// ResultContextKey is the context key of the *GeoIPResult of the client of a request,
+// for middlewares later in the chain.
+var ResultContextKey = &contextKey{"geoip2-result"}
+
+// ResultFromContext returns the lookup result stored in ctx, false when there is none.
+func ResultFromContext(ctx context.Context) (*GeoIPResult, bool) {
+	record, ok := ctx.Value(ResultContextKey).(*GeoIPResult)
+	return record, ok
+}
+
+// geoValue is a value of a lookup with its JSON name and header. A value that is empty and
+// not required removes the header, so a client cannot supply the value itself.
+type geoValue struct {
+	name     string
+	header   string
+	value    string
+	required bool
+}
+
+// apply sets the value in header.
+func (v geoValue) apply(header http.Header) {
+	if v.value == "" && !v.required {
+		header.Del(v.header)
+		return
+	}
+	header.Set(v.header, v.value)
+}
+
+// geoValues returns the selected values of record in the order of the headers. Values not
+// selected are not computed.
+func (mw *TraefikGeoIP2) geoValues(record *GeoIPResult) []geoValue {
+	// The record may be shared through the cache, it must not be modified here.
+	values := make([]geoValue, 0, 64)
+	add := func(name string, compute func() geoValue) {
+		if mw.wants(name) {
+			values = append(values, compute())
+		}
+	}
+	names := record.names
+	if names == nil {
+		names = &placeNames{}
+	}
+	regionCodes := mw.regionCodes && record.region != Private
+	region2, subdivisions := record.region2, record.subdivisions
+	if regionCodes {
+		region2, subdivisions = record.region2Code, record.subdivisionCodes
+	}
+
+	add("continent", func() geoValue {
+		return geoValue{name: "continent", header: mw.header(ContinentHeader), value: record.Continent()}
+	})
+	add("country", func() geoValue {
+		return mw.placeValue("country", mw.headers.Country, mw.formatCountry(record.country))
+	})
+	add("countryName", func() geoValue {
+		return mw.encoded(geoValue{name: "countryName", header: mw.header(CountryNameHeader), value: localizedName(names.country, mw.locales)})
+	})
+	add("registeredCountry", func() geoValue {
+		return geoValue{name: "registeredCountry", header: mw.header(RegisteredCountryHeader), value: mw.formatCountry(record.registered)}
+	})
+	add("representedCountry", func() geoValue {
+		return geoValue{name: "representedCountry", header: mw.header(RepresentedCountryHeader), value: mw.formatCountry(record.represented)}
+	})
+	add("currency", func() geoValue {
+		return geoValue{name: "currency", header: mw.header(CurrencyHeader), value: countryCurrencies[record.country]}
+	})
+	add("callingCode", func() geoValue {
+		value := geoValue{name: "callingCode", header: mw.header(CallingCodeHeader)}
+		if mw.callingCode {
+			value.value = countryCallingCodes[record.country]
+		}
+		return value
+	})
+	add("region", func() geoValue {
+		region := firstNonEmpty(localizedName(names.region, mw.locales), record.region)
+		if regionCodes {
+			region = record.regionCode
+		}
+		return mw.encoded(mw.placeValue("region", mw.headers.Region, region))
+	})
+	add("region2", func() geoValue {
+		return mw.encoded(geoValue{name: "region2", header: mw.header(Region2Header), value: region2})
+	})
+	add("subdivisions", func() geoValue {
+		return geoValue{name: "subdivisions", header: mw.header(SubdivisionsHeader), value: mw.joinSubdivisions(subdivisions)}
+	})
+	add("city", func() geoValue {
+		return mw.encoded(mw.placeValue("city", mw.headers.City, firstNonEmpty(localizedName(names.city, mw.locales), record.city)))
+	})
+	add("asn", func() geoValue {
+		return geoValue{name: "asn", header: mw.header(ASNHeader), value: formatUint(uint64(record.asn))}
+	})
+	add("asOrg", func() geoValue {
+		return mw.encoded(geoValue{name: "asOrg", header: mw.header(ASOrgHeader), value: record.asOrg})
+	})
+	mw.locationValues(add, record.location)
+	add("isp", func() geoValue {
+		return mw.encoded(geoValue{name: "isp", header: mw.header(ISPHeader), value: record.isp})
+	})
+	add("organization", func() geoValue {
+		return mw.encoded(geoValue{name: "organization", header: mw.header(OrganizationHeader), value: record.organization})
+	})
+	add("connectionType", func() geoValue {
+		return geoValue{name: "connectionType", header: mw.header(ConnectionTypeHeader), value: record.connectionType}
+	})
+	add("countryConfidence", func() geoValue {
+		return geoValue{name: "countryConfidence", header: mw.header(CountryConfidenceHeader), value: formatUint(uint64(record.countryConfidence))}
+	})
+	add("regionConfidence", func() geoValue {
+		return geoValue{name: "regionConfidence", header: mw.header(RegionConfidenceHeader), value: formatUint(uint64(record.regionConfidence))}
+	})
+	add("cityConfidence", func() geoValue {
+		return geoValue{name: "cityConfidence", header: mw.header(CityConfidenceHeader), value: formatUint(uint64(record.cityConfidence))}
+	})
+	add("userType", func() geoValue {
+		return geoValue{name: "userType", header: mw.header(UserTypeHeader), value: record.userType}
+	})
+	add("mobileCountryCode", func() geoValue {
+		return geoValue{name: "mobileCountryCode", header: mw.header(MCCHeader), value: record.mcc}
+	})
+	add("mobileNetworkCode", func() geoValue {
+		return geoValue{name: "mobileNetworkCode", header: mw.header(MNCHeader), value: record.mnc}
+	})
+	mw.anonymousValues(add, record.anonymous)
+	mw.traitValues(add, record.traits)
+	for _, header := range mw.fields {
+		header := header
+		add(header, func() geoValue {
+			return geoValue{name: header, header: header, value: sanitize(record.fields[header], mw.maxValueLength)}
+		})
+	}
+	var templateValues map[string]string
+	for _, custom := range mw.customHeaders {
+		custom := custom
+		add(custom.name, func() geoValue {
+			if templateValues == nil {
+				templateValues = mw.templateValues(record)
+			}
+			return geoValue{name: custom.name, header: custom.name, value: sanitize(custom.value(templateValues), mw.maxValueLength)}
+		})
+	}
+	for _, countryMap := range mw.countryMaps {
+		countryMap := countryMap
+		add(countryMap.header, func() geoValue {
+			return geoValue{name: countryMap.header, header: countryMap.header, value: countryMap.value(record.country)}
+		})
+	}
+	if mw.languageHint == LanguageHintHeader {
+		add("suggestedLanguage", func() geoValue {
+			return geoValue{name: "suggestedLanguage", header: mw.languages.header, value: mw.languages.value(record.country)}
+		})
+	}
+	add("stale", func() geoValue {
+		return geoValue{name: "stale", header: mw.header(StaleHeader), value: mw.stale()}
+	})
+	add("network", func() geoValue {
+		return geoValue{name: "network", header: mw.header(NetworkHeader), value: record.network}
+	})
+	add("source", func() geoValue {
+		return geoValue{name: "source", header: mw.header(SourceHeader), value: record.source}
+	})
+	return values
+}
+
+// addValue appends the value of name computed by compute when it is selected.
+type addValue func(name string, compute func() geoValue)
+
+// joinSubdivisions returns the encoded subdivisions joined by the subdivisionSeparator,
+// "" when one of them is not known.
+func (mw *TraefikGeoIP2) joinSubdivisions(subdivisions []string) string {
+	encoded := make([]string, 0, len(subdivisions))
+	for _, subdivision := range subdivisions {
+		if subdivision == "" {
+			return ""
+		}
+		encoded = append(encoded, mw.encoded(geoValue{value: subdivision}).value)
+	}
+	return strings.Join(encoded, mw.subdivisionSeparator)
+}
+
+// wants reports whether one of the values of names is selected, all are before the selection
+// is set.
+func (mw *TraefikGeoIP2) wants(names ...string) bool {
+	if mw.selected == nil {
+		return true
+	}
+	for _, name := range names {
+		if mw.selected[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// recordParts returns the parts of the records the selected values, the rules, the templates
+// and the peer headers use, the others are not extracted from the records.
+func (mw *TraefikGeoIP2) recordParts() recordParts {
+	all := len(mw.customHeaders) > 0 || mw.blocked.page != nil || mw.blocked.redirect != nil || mw.peerLookup
+	parts := recordParts{
+		region: all || mw.wants("region", "region2", "subdivisions"),
+		city:   all || mw.wants("city"),
+	}
+	if mw.rules != nil {
+		parts.region = parts.region || len(mw.rules.allowedRegions) > 0 || len(mw.rules.blockedRegions) > 0
+		parts.city = parts.city || len(mw.rules.allowedCities) > 0 || len(mw.rules.blockedCities) > 0
+	}
+	return parts
+}
+
+// fieldGroups the values set together by one name of enabledFields.
+var fieldGroups = map[string][]string{
+	"latlong": {"latitude", "longitude"},
+}
+
+// optionalValues are only set when turned on in enabledFields or listed in outputFields.
+var optionalValues = map[string]bool{
+	"metroCode":           true,
+	"registeredCountry":   true,
+	"representedCountry":  true,
+	"isAnonymousProxy":    true,
+	"isSatelliteProvider": true,
+	"localTime":           true,
+	"currency":            true,
+}
+
+// knownValues returns the names of all values, before the selection is set.
+func (mw *TraefikGeoIP2) knownValues() map[string]bool {
+	known := make(map[string]bool)
+	for _, value := range mw.geoValues(&GeoIPResult{}) {
+		known[value.name] = true
+	}
+	return known
+}
+
+// newSelection validates the outputFields and enabledFields against the known values. The
+// enabledFields turn values on and off, all but the optionalValues are selected unless a
+// value other than an optional one is turned on or outputFields are set.
+func newSelection(known map[string]bool, names []string, enabled map[string]bool) (map[string]bool, error) {
+	selected := make(map[string]bool, len(known))
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unsupported outputFields value `%s'", name)
+		}
+		selected[name] = true
+	}
+	all := len(names) == 0
+	for field, on := range enabled {
+		all = all && !(on && !optionalValues[field])
+	}
+	if all {
+		for name := range known {
+			if !optionalValues[name] {
+				selected[name] = true
+			}
+		}
+	}
+	for field, on := range enabled {
+		group, ok := fieldGroups[field]
+		if !ok {
+			group = []string{field}
+		}
+		for _, name := range group {
+			if !known[name] {
+				return nil, fmt.Errorf("unsupported enabledFields value `%s'", field)
+			}
+			if on {
+				selected[name] = true
+			} else {
+				delete(selected, name)
+			}
+		}
+	}
+	return selected, nil
+}
+
+// placeValue returns a country, region or city value. Unknown values are set to the
+// placeholder, or the header is removed with the omit unknownBehaviour.
+func (mw *TraefikGeoIP2) placeValue(name, header, value string) geoValue {
+	if value == "" || value == Unknown {
+		if mw.omitUnknown {
+			return geoValue{name: name, header: header}
+		}
+		value = mw.placeholder
+	}
+	return geoValue{name: name, header: header, value: value, required: true}
+}
+
+// locationValues adds the coordinates of location, their accuracy, the metro code, the
+// geohash with geoHashPrecision, the local time, the distance to distanceFrom and the
+// geoZonesPath zone, empty when location is nil.
+func (mw *TraefikGeoIP2) locationValues(add addValue, location *geoip2.Location) {
+	value := func(name, header string, format func(location *geoip2.Location) string) {
+		add(name, func() geoValue {
+			value := geoValue{name: name, header: mw.header(header)}
+			if location != nil {
+				value.value = format(location)
+			}
+			return value
+		})
+	}
+	value("latitude", LatitudeHeader, func(location *geoip2.Location) string {
+		return strconv.FormatFloat(location.Latitude, 'f', mw.precision, 64)
+	})
+	value("longitude", LongitudeHeader, func(location *geoip2.Location) string {
+		return strconv.FormatFloat(location.Longitude, 'f', mw.precision, 64)
+	})
+	value("accuracyRadius", AccuracyRadiusHeader, func(location *geoip2.Location) string {
+		return formatUint(uint64(location.AccuracyRadius))
+	})
+	value("metroCode", MetroCodeHeader, func(location *geoip2.Location) string {
+		return formatUint(uint64(location.MetroCode))
+	})
+	value("geoHash", GeoHashHeader, func(location *geoip2.Location) string {
+		return geoHash(location.Latitude, location.Longitude, mw.geoHashPrecision)
+	})
+	value("localTime", LocalTimeHeader, func(location *geoip2.Location) string {
+		return localTime(location.TimeZone, time.Now())
+	})
+	value("distance", DistanceHeader, func(location *geoip2.Location) string {
+		if mw.distanceFrom == nil {
+			return ""
+		}
+		distance := mw.distanceFrom.distance(coordinate{location.Latitude, location.Longitude})
+		return strconv.FormatFloat(distance, 'f', 0, 64)
+	})
+	value("zone", ZoneHeader, func(location *geoip2.Location) string {
+		return zoneOf(mw.zones, coordinateOf(location))
+	})
+}
+
+// flagValue adds the flag name, empty when known is false.
+func (mw *TraefikGeoIP2) flagValue(add addValue, name, header string, known, flag bool) {
+	add(name, func() geoValue {
+		value := geoValue{name: name, header: mw.header(header)}
+		if known {
+			value.value = strconv.FormatBool(flag)
+		}
+		return value
+	})
+}
+
+// anonymousValues adds the Anonymous-IP flags, empty when no Anonymous-IP database has
+// been looked up.
+func (mw *TraefikGeoIP2) anonymousValues(add addValue, anonymous *geoip2.AnonymousIP) {
+	known := anonymous != nil
+	if !known {
+		anonymous = &geoip2.AnonymousIP{}
+	}
+	mw.flagValue(add, "isAnonymous", IsAnonymousHeader, known, anonymous.IsAnonymous)
+	mw.flagValue(add, "isVpn", IsVPNHeader, known, anonymous.IsAnonymousVPN)
+	mw.flagValue(add, "isTorExit", IsTorExitHeader, known, anonymous.IsTorExitNode)
+	mw.flagValue(add, "isHosting", IsHostingHeader, known, anonymous.IsHostingProvider)
+	mw.flagValue(add, "isPublicProxy", IsPublicProxyHeader, known, anonymous.IsPublicProxy)
+	mw.flagValue(add, "isResidentialProxy", IsResidentialProxyHeader, known, anonymous.IsResidentialProxy)
+}
+
+// traitValues adds the trait flags, empty when no City or Country database has been
+// looked up.
+func (mw *TraefikGeoIP2) traitValues(add addValue, traits *traitFlags) {
+	known := traits != nil
+	if !known {
+		traits = &traitFlags{}
+	}
+	mw.flagValue(add, "isAnonymousProxy", IsAnonymousProxyHeader, known, traits.anonymousProxy)
+	mw.flagValue(add, "isSatelliteProvider", IsSatelliteProviderHeader, known, traits.satelliteProvider)
+	mw.flagValue(add, "isAnycast", IsAnycastHeader, known, traits.anycast)
+}
+
+// geoJSON returns the values set as a compact JSON object by name.
+func geoJSON(values []geoValue) string {
+	object := make(map[string]string, len(values))
+	for _, value := range values {
+		if value.value != "" || value.required {
+			object[value.name] = value.value
+		}
+	}
+	content, err := json.Marshal(object)
+	if err != nil {
+		return "{}"
+	}
+	return string(content)
+}
+
+// templateValues returns the values of record by name for the templates, e.g. `Country`,
+// and the configured record fields by header. Templates get plain strings rather than the
+// result and its methods, as method calls on interpreted types are unreliable under yaegi.
+func (mw *TraefikGeoIP2) templateValues(record *GeoIPResult) map[string]string {
+	values := make(map[string]string, 16+len(record.fields))
+	for header, value := range record.fields {
+		values[header] = value
+	}
+	values["Continent"] = record.Continent()
+	values["Country"] = record.country
+	values["RegisteredCountry"] = record.registered
+	values["RepresentedCountry"] = record.represented
+	values["Region"] = record.region
+	values["RegionCode"] = record.regionCode
+	values["Subdivisions"] = strings.Join(record.subdivisions, mw.subdivisionSeparator)
+	values["City"] = record.city
+	values["ASN"] = formatUint(uint64(record.asn))
+	values["ASOrg"] = record.asOrg
+	values["ISP"] = record.isp
+	values["Organization"] = record.organization
+	values["ConnectionType"] = record.connectionType
+	values["Network"] = record.network
+	values["Source"] = record.source
+	return values
+}
+
+// customHeader a header set to a template over the templateValues, e.g.
+// `{{.Continent}}-{{.Country}}`.
+type customHeader struct {
+	name string
+	tmpl *template.Template
+}
+
+// parseCustomHeaders parses the templates of the customHeaders, sorted by header.
+func parseCustomHeaders(headers map[string]string) ([]customHeader, error) {
+	customs := make([]customHeader, 0, len(headers))
+	for name, text := range headers {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid customHeaders template of `%s': %w", name, err)
+		}
+		customs = append(customs, customHeader{name: http.CanonicalHeaderKey(name), tmpl: tmpl})
+	}
+	sort.Slice(customs, func(i, j int) bool { return customs[i].name < customs[j].name })
+	return customs, nil
+}
+
+// newlines are replaced in template output, which is not valid in a header value.
+var newlines = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// value executes the template for the templateValues, "" when it fails.
+func (c customHeader) value(values map[string]string) string {
+	var value strings.Builder
+	if err := c.tmpl.Execute(&value, values); err != nil {
+		logWarn.Printf("customHeaders template of `%s' failed: %v", c.name, err)
+		return ""
+	}
+	return strings.TrimSpace(newlines.Replace(value.String()))
+}
+
+// timeZones caches the locations loaded by time zone name, nil for unknown zones.
+var timeZones sync.Map
+
+// localTime returns now in the IANA time zone as RFC 3339 time with offset,
+// e.g. `2024-01-02T15:04:05+01:00`, "" when the zone is empty or unknown.
+func localTime(zone string, now time.Time) string {
+	if zone == "" {
+		return ""
+	}
+	cached, ok := timeZones.Load(zone)
+	if !ok {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			logWarn.Printf("Unknown time zone `%s': %v", zone, err)
+		}
+		cached, _ = timeZones.LoadOrStore(zone, location)
+	}
+	location, _ := cached.(*time.Location)
+	if location == nil {
+		return ""
+	}
+	return now.In(location).Format(time.RFC3339)
+}
+
+// geoHashAlphabet the base32 alphabet of geohashes.
+const geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geoHash returns the geohash of latitude and longitude with precision characters,
+// "" when precision is 0.
+func geoHash(latitude, longitude float64, precision int) string {
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even, bits, index := true, 0, 0
+	for len(hash) < precision {
+		// Bits alternate between longitude and latitude, starting with longitude.
+		value, bounds := latitude, &latRange
+		if even {
+			value, bounds = longitude, &lonRange
+		}
+		mid := (bounds[0] + bounds[1]) / 2
+		index <<= 1
+		if value >= mid {
+			index |= 1
+			bounds[0] = mid
+		} else {
+			bounds[1] = mid
+		}
+		even = !even
+
+		if bits++; bits == 5 {
+			hash = append(hash, geoHashAlphabet[index])
+			bits, index = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// earthRadius mean radius of the earth in km.
+const earthRadius = 6371.0
+
+// coordinate a latitude and longitude in degrees.
+type coordinate struct {
+	latitude, longitude float64
+}
+
+// coordinateOf returns the coordinate of location, nil when location is nil.
+func coordinateOf(location *geoip2.Location) *coordinate {
+	if location == nil {
+		return nil
+	}
+	return &coordinate{location.Latitude, location.Longitude}
+}
+
+// parseCoordinate parses the `latitude,longitude' value of option name.
+func parseCoordinate(name, value string) (*coordinate, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid %s coordinate `%s'", name, value)
+	}
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return nil, fmt.Errorf("invalid %s latitude `%s'", name, parts[0])
+	}
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return nil, fmt.Errorf("invalid %s longitude `%s'", name, parts[1])
+	}
+	return &coordinate{latitude, longitude}, nil
+}
+
+// distance returns the great-circle distance in km between c and other.
+func (c coordinate) distance(other coordinate) float64 {
+	lat1, lat2 := c.latitude*math.Pi/180, other.latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (other.longitude - c.longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// queryParam a query parameter set to the value of name.
+type queryParam struct {
+	name  string
+	param string
+}
+
+// newQueryParams validates the queryParams against the known values, the query parameters
+// by value name, sorted by parameter. Values must be selected to be set.
+func (mw *TraefikGeoIP2) newQueryParams(known map[string]bool, params map[string]string) ([]queryParam, error) {
+	queryParams := make([]queryParam, 0, len(params))
+	for name, param := range params {
+		if !known[name] {
+			return nil, fmt.Errorf("unsupported queryParams value `%s'", name)
+		}
+		if !mw.wants(name) {
+			return nil, fmt.Errorf("queryParams value `%s' is not selected by outputFields or enabledFields", name)
+		}
+		queryParams = append(queryParams, queryParam{name: name, param: firstNonEmpty(param, name)})
+	}
+	sort.Slice(queryParams, func(i, j int) bool { return queryParams[i].param < queryParams[j].param })
+	return queryParams, nil
+}
+
+// setQueryParams sets the queryParams in the URL of req. Parameters the client sent under
+// these names are replaced, or removed when the value is unknown.
+func (mw *TraefikGeoIP2) setQueryParams(req *http.Request, values []geoValue) {
+	query := req.URL.Query()
+	for _, param := range mw.queryParams {
+		query.Del(param.param)
+		for _, value := range values {
+			if value.name == param.name && (value.value != "" || value.required) {
+				query.Set(param.param, value.value)
+			}
+		}
+	}
+	req.URL.RawQuery = query.Encode()
+}
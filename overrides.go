@@ -0,0 +1,61 @@
+package traefikgeoip2
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var errNotInOverrides = errors.New("not found in overrides")
+
+// Override static geo values of a network.
+type Override struct {
+	CIDR    string `json:"cidr,omitempty"`
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	City    string `json:"city,omitempty"`
+}
+
+// staticOverride an override with its parsed network.
+type staticOverride struct {
+	network *net.IPNet
+	result  GeoIPResult
+}
+
+// newStaticLookup answers from overrides, the first override whose network contains an
+// address is used. It returns nil when there are no overrides.
+func newStaticLookup(overrides []Override) (LookupGeoIP2, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+
+	entries := make([]staticOverride, 0, len(overrides))
+	for _, override := range overrides {
+		networks, err := parseCIDRs("overrides", []string{override.CIDR})
+		if err != nil {
+			return nil, err
+		}
+		if override.Country == "" {
+			return nil, fmt.Errorf("override `%s' needs a country", override.CIDR)
+		}
+		entries = append(entries, staticOverride{
+			network: networks[0],
+			result: GeoIPResult{
+				country: strings.ToUpper(override.Country),
+				region:  override.Region,
+				city:    override.City,
+			},
+		})
+	}
+
+	return func(ip net.IP) (*GeoIPResult, error) {
+		for _, entry := range entries {
+			if entry.network.Contains(ip) {
+				result := entry.result
+				return &result, nil
+			}
+		}
+		return nil, errNotInOverrides
+	}, nil
+}
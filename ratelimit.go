@@ -0,0 +1,86 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit a token bucket refilled by Average requests per second, holding up to Burst.
+type RateLimit struct {
+	Average float64 `json:"average,omitempty"`
+	Burst   int     `json:"burst,omitempty"`
+}
+
+// rateLimiter the token buckets of countryRateLimits, one per country.
+type rateLimiter struct {
+	limits  map[string]RateLimit
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket the tokens left at the last request.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns the limiter of limits by country, the one of `*' is used for other
+// countries. It returns nil when there are no limits. The burst defaults to the average.
+func newRateLimiter(limits map[string]RateLimit) (*rateLimiter, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	limiter := &rateLimiter{limits: make(map[string]RateLimit, len(limits)), buckets: map[string]*tokenBucket{}}
+	for country, limit := range limits {
+		if limit.Average <= 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("invalid countryRateLimits of `%s'", country)
+		}
+		if limit.Burst == 0 {
+			limit.Burst = int(math.Max(1, math.Ceil(limit.Average)))
+		}
+		limiter.limits[strings.ToUpper(country)] = limit
+	}
+	return limiter, nil
+}
+
+// take takes a token of the bucket of country at now, it returns how long to wait for one
+// when there is none, 0 when it is taken or the country has no limit.
+func (l *rateLimiter) take(country string, now time.Time) time.Duration {
+	country = strings.ToUpper(country)
+	limit, ok := l.limits[country]
+	if !ok {
+		if limit, ok = l.limits[CountryMapDefault]; !ok {
+			return 0
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.buckets[country]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[country] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Average)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / limit.Average * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+// throttle rejects req of the client from country with 429 Too Many Requests, to be retried
+// after wait.
+func (mw *TraefikGeoIP2) throttle(rw http.ResponseWriter, req *http.Request, country string, wait time.Duration) {
+	logInfo.Printf("Rate limited request for %s from country %s", req.URL.Path, country)
+	rw.Header().Set(RetryAfterHeader, strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
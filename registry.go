@@ -0,0 +1,116 @@
+package traefikgeoip2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// registry shares databases and caches between middleware instances, so routers using
+// the same database do not each hold a copy of it in memory. Entries are counted by the
+// instances using them and dropped when the last one is released.
+var registry = struct {
+	sync.Mutex
+	databases map[string]*database
+	caches    map[string]*sharedCacheEntry
+	refs      map[*database]int
+}{
+	databases: map[string]*database{},
+	caches:    map[string]*sharedCacheEntry{},
+	refs:      map[*database]int{},
+}
+
+// sharedCacheEntry a shared cache with the number of instances using it.
+type sharedCacheEntry struct {
+	cache *cache.Cache
+	refs  int
+}
+
+// sharedDatabase returns the database registered with the settings of db.
+// It registers db when there is none yet, its background jobs run until it is released.
+func sharedDatabase(db *database) *database {
+	registry.Lock()
+	defer registry.Unlock()
+
+	key := db.key()
+	if shared, ok := registry.databases[key]; ok {
+		registry.refs[shared]++
+		return shared
+	}
+	db.ctx, db.stop = context.WithCancel(context.Background())
+	registry.databases[key] = db
+	registry.refs[db] = 1
+	return db
+}
+
+// releaseDatabase drops a reference to db, which is unregistered and stopped when it was
+// the last one.
+func releaseDatabase(db *database) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.refs[db]--; registry.refs[db] > 0 {
+		return
+	}
+	delete(registry.refs, db)
+	if registry.databases[db.key()] == db {
+		delete(registry.databases, db.key())
+	}
+	db.stop()
+}
+
+// cacheKey returns the key of the cache of the lookup chain of cfg over dbs: the databases,
+// the override database, the overrides and the built-in fallback.
+func cacheKey(cfg *Config, dbs []*database) string {
+	keys := make([]string, 0, len(dbs)+1)
+	for i, db := range dbs {
+		if cfg.OverrideDBPath != "" && i == len(dbs)-1 {
+			keys = append(keys, "override "+db.key())
+			continue
+		}
+		keys = append(keys, db.key())
+	}
+	keys = append(keys, fmt.Sprintf("%v|%v", cfg.Overrides, cfg.BuiltinFallback))
+	return strings.Join(keys, "\n")
+}
+
+// sharedCache returns the cache of the instances with the same lookup chain under key.
+func sharedCache(key string) *cache.Cache {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if entry, ok := registry.caches[key]; ok {
+		entry.refs++
+		return entry.cache
+	}
+	c := cache.New(DefaultCacheExpire, DefaultCachePurge)
+	registry.caches[key] = &sharedCacheEntry{cache: c, refs: 1}
+	return c
+}
+
+// releaseCache drops a reference to the shared cache of key.
+func releaseCache(key string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if entry, ok := registry.caches[key]; ok {
+		if entry.refs--; entry.refs <= 0 {
+			delete(registry.caches, key)
+		}
+	}
+}
+
+// release returns the databases and the shared cache of mw to the registry, once it is no
+// longer used.
+func (mw *TraefikGeoIP2) release() {
+	for _, db := range mw.databases {
+		db.removeCache(mw.cache)
+		releaseDatabase(db)
+	}
+	if mw.cacheKey != "" {
+		releaseCache(mw.cacheKey)
+	}
+}
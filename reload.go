@@ -0,0 +1,172 @@
+package traefikgeoip2
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dbState identifies a version of the database file on disk.
+type dbState struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func newDBState(path string, info os.FileInfo) dbState {
+	return dbState{path: path, modTime: info.ModTime(), size: info.Size()}
+}
+
+// watch polls the file of db every interval and reloads the database when the file changes.
+// It stops when ctx is done.
+func (db *database) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !db.changed() {
+				continue
+			}
+			db.reload()
+		}
+	}
+}
+
+// reloadEvery reopens db every interval regardless of whether the file changed.
+// It stops when ctx is done.
+func (db *database) reloadEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.reload()
+		}
+	}
+}
+
+// retry reopens db every interval until it succeeds, remote databases are downloaded again.
+// It stops when ctx is done.
+func (db *database) retry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if db.getLookup() != nil {
+				return
+			}
+			if db.upd != nil {
+				if _, err := db.upd.update(); err != nil {
+					logWarn.Printf("GeoIP DB `%s' not downloaded: %v", db.upd.url, err)
+					continue
+				}
+			}
+			if _, err := os.Stat(db.source()); err != nil {
+				continue
+			}
+			if db.reload() {
+				return
+			}
+		}
+	}
+}
+
+// reload reopens db and swaps it in, dropping results cached from the previous one.
+// The previous lookup keeps serving requests if the new file cannot be opened.
+func (db *database) reload() bool {
+	source := db.source()
+	info, err := os.Stat(source)
+	if err != nil {
+		logWarn.Printf("GeoIP DB `%s' not reloaded: %v", db.path, err)
+		return false
+	}
+	version, err := db.load(source, info)
+	if err != nil {
+		logWarn.Printf("GeoIP DB `%s' not reloaded: %v", db.path, err)
+		return false
+	}
+	db.setVersion(version)
+	logInfo.Printf("GeoIP DB `%s' reloaded", db.path)
+	db.checkAge()
+	return true
+}
+
+// reloadGate coalesces reloads of the reload path: requests arriving during a reload share
+// its result, and reloads are at least ReloadCooldown apart.
+type reloadGate struct {
+	mu      sync.Mutex
+	pending *reloadCall
+	last    time.Time
+}
+
+// reloadCall a running reload, done is closed with the paths of the databases that failed.
+type reloadCall struct {
+	done   chan struct{}
+	failed []string
+}
+
+// serveReload reopens every database on a POST to the reload path with the reloadSecret,
+// e.g. after an out-of-band update of the files.
+func (mw *TraefikGeoIP2) serveReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := req.Header.Get(ReloadSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(mw.reloadSecret)) != 1 {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	gate := mw.reloads
+	gate.mu.Lock()
+	call := gate.pending
+	if call == nil {
+		if wait := ReloadCooldown - time.Since(gate.last); wait > 0 {
+			gate.mu.Unlock()
+			rw.Header().Set(RetryAfterHeader, strconv.Itoa(int(wait/time.Second)+1))
+			http.Error(rw, "reloaded recently", http.StatusTooManyRequests)
+			return
+		}
+		call = &reloadCall{done: make(chan struct{})}
+		gate.pending = call
+		gate.mu.Unlock()
+
+		for _, db := range mw.databases {
+			if !db.reload() {
+				call.failed = append(call.failed, db.path)
+			}
+		}
+		gate.mu.Lock()
+		gate.pending, gate.last = nil, time.Now()
+		gate.mu.Unlock()
+		close(call.done)
+	} else {
+		gate.mu.Unlock()
+		<-call.done
+	}
+
+	if failed := call.failed; len(failed) > 0 {
+		http.Error(rw, "not reloaded: "+strings.Join(failed, ", "), http.StatusInternalServerError)
+		return
+	}
+	_, _ = fmt.Fprintf(rw, "reloaded %d databases\n", len(mw.databases))
+}
@@ -0,0 +1,413 @@
+package traefikgeoip2_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mw "github.com/sopov/traefikgeoip2"
+)
+
+func TestGeoIPWatchReload(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.WatchInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("AT", "Vienna", "Vienna"),
+	})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(mwCfg.DBPath, future, future); err != nil {
+		t.Fatalf("Unable to touch DB: %v", err)
+	}
+
+	waitForHeader(t, instance, ValidIPAndPort, mw.CityHeader, "Vienna")
+}
+
+func TestGeoIPReloadInterval(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.ReloadInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("AT", "Vienna", "Vienna"),
+	})
+
+	waitForHeader(t, instance, ValidIPAndPort, mw.CityHeader, "Vienna")
+}
+
+func TestGeoIPRetryMissingDB(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = dir + "/GeoLite2-City.mmdb"
+	mwCfg.RetryInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, mw.Unknown)
+
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+
+	waitForHeader(t, instance, ValidIPAndPort, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPSharedDatabaseReload(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+
+	mwCfg.ReloadPath = "/_geoip/reload"
+	mwCfg.ReloadSecret = "s3cret"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	first, err := mw.New(ctx, next, mwCfg, "first")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	second, err := mw.New(ctx, next, mwCfg, "second")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	mwCfg.MaxDBAge = "1080h"
+	other, err := mw.New(ctx, next, mwCfg, "other")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	for _, instance := range []http.Handler{first, second, other} {
+		assertCity(t, instance, "Munich")
+	}
+
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("AT", "Vienna", "Vienna"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/_geoip/reload", nil)
+	req.Header.Set(mw.ReloadSecretHeader, "s3cret")
+	rw := httptest.NewRecorder()
+	second.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Must reload, got %d: %s", rw.Code, rw.Body)
+	}
+
+	// The first instance shares the database reloaded by the second one, the instance with
+	// another maxDbAge has a database of its own.
+	assertCity(t, second, "Vienna")
+	assertCity(t, first, "Vienna")
+	assertCity(t, other, "Munich")
+}
+
+// assertCity checks the city instance sets for ValidIP.
+func assertCity(t *testing.T, instance http.Handler, expected string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, expected)
+}
+
+func TestGeoIPSharedDatabaseRelease(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.WatchInterval = "10ms"
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := mw.New(firstCtx, next, mwCfg, "first"); err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	second, err := mw.New(secondCtx, next, mwCfg, "second")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	// The watch started by the first instance keeps running for the second one.
+	cancelFirst()
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("AT", "Vienna", "Vienna"),
+	})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(mwCfg.DBPath, future, future); err != nil {
+		t.Fatalf("Unable to touch DB: %v", err)
+	}
+	waitForHeader(t, second, ValidIPAndPort, mw.CityHeader, "Vienna")
+}
+
+func TestGeoIPSharedCacheOverrides(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.SharedCache = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	plain, err := mw.New(context.TODO(), next, mwCfg, "plain")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	mwCfg.Overrides = []mw.Override{{CIDR: ValidIP + "/32", Country: "FR", City: "Paris"}}
+	overridden, err := mw.New(context.TODO(), next, mwCfg, "overridden")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		instance http.Handler
+		expected string
+	}{
+		{instance: overridden, expected: "Paris"},
+		{instance: plain, expected: "Munich"},
+		{instance: overridden, expected: "Paris"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = ValidIPAndPort
+		tc.instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mw.CityHeader, tc.expected)
+	}
+}
+
+func TestGeoIPGlobPath(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("GEOIP_TEST_DIR", dir)
+	defer os.Unsetenv("GEOIP_TEST_DIR")
+
+	writeTestDB(t, dir, "GeoLite2-City_20200101.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = "${GEOIP_TEST_DIR}/GeoLite2-City_*.mmdb"
+	mwCfg.WatchInterval = "10ms"
+	mwCfg.FailOnError = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	newer := writeTestDB(t, dir, "GeoLite2-City_20200108.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("AT", "Vienna", "Vienna"),
+	})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(newer, future, future); err != nil {
+		t.Fatalf("Unable to touch DB: %v", err)
+	}
+
+	waitForHeader(t, instance, ValidIPAndPort, mw.CityHeader, "Vienna")
+}
+
+func TestGeoIPConcurrentReload(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.ReloadInterval = "1ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				req.RemoteAddr = ValidIPAndPort
+				instance.ServeHTTP(httptest.NewRecorder(), req)
+				if city := req.Header.Get(mw.CityHeader); city != "Munich" {
+					t.Errorf("Lookup dropped during reload, city: %s", city)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGeoIPReloadPath(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+	mwCfg.ReloadPath = "/_geoip/reload"
+	mwCfg.ReloadSecret = "s3cret"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == mwCfg.ReloadPath {
+			t.Errorf("Reload requests must not be forwarded")
+		}
+	})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("AT", "Vienna", "Vienna"),
+	})
+
+	rw := httptest.NewRecorder()
+	instance.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/_geoip/reload", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Must refuse GET, got %d", rw.Code)
+	}
+
+	post := func(secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/_geoip/reload", nil)
+		if secret != "" {
+			req.Header.Set(mw.ReloadSecretHeader, secret)
+		}
+		rw := httptest.NewRecorder()
+		instance.ServeHTTP(rw, req)
+		return rw
+	}
+	for _, secret := range []string{"", "wrong"} {
+		if rw = post(secret); rw.Code != http.StatusForbidden {
+			t.Fatalf("Must refuse secret %q, got %d", secret, rw.Code)
+		}
+	}
+
+	if rw = post("s3cret"); rw.Code != http.StatusOK {
+		t.Fatalf("Must reload, got %d: %s", rw.Code, rw.Body)
+	}
+	waitForHeader(t, instance, ValidIPAndPort, mw.CityHeader, "Vienna")
+
+	if rw = post("s3cret"); rw.Code != http.StatusTooManyRequests || rw.Header().Get(mw.RetryAfterHeader) == "" {
+		t.Fatalf("Must refuse a reload within the cooldown, got %d", rw.Code)
+	}
+
+	mwCfg.ReloadSecret = ""
+	if _, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on reloadPath without reloadSecret")
+	}
+}
+
+func TestGeoIPLazyOpen(t *testing.T) {
+	dir := t.TempDir()
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = dir + "/GeoLite2-City.mmdb"
+	mwCfg.LazyOpen = true
+	mwCfg.FailOnError = true
+	mwCfg.RetryInterval = "10ms"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Must not open the database on start: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, mw.Unknown)
+
+	writeTestDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	})
+
+	waitForHeader(t, instance, ValidIPAndPort, mw.CityHeader, "Munich")
+}
+
+func TestGeoIPWatchInvalidInterval(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.WatchInterval = "often"
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on invalid watchInterval")
+	}
+
+	mwCfg = mw.CreateConfig()
+	mwCfg.ReloadInterval = "daily"
+	if _, err := mw.New(context.TODO(), nil, mwCfg, ""); err == nil {
+		t.Fatalf("Must fail on invalid reloadInterval")
+	}
+}
+
+// waitForHeader repeats requests from remoteAddr until header has the expected value.
+func waitForHeader(t *testing.T, instance http.Handler, remoteAddr, key, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		if req.Header.Get(key) == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("invalid value of header [%s] != %s", key, req.Header.Get(key))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
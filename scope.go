@@ -0,0 +1,72 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RequestMatch matches requests by path and method, all of the set conditions must match.
+type RequestMatch struct {
+	PathPrefix string   `json:"pathPrefix,omitempty"`
+	PathRegex  string   `json:"pathRegex,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+}
+
+// requestMatch a RequestMatch with its compiled regular expression.
+type requestMatch struct {
+	prefix  string
+	regex   *regexp.Regexp
+	methods map[string]bool
+}
+
+// newRequestMatches parses the matches of option name.
+func newRequestMatches(name string, matches []RequestMatch) ([]requestMatch, error) {
+	parsed := make([]requestMatch, 0, len(matches))
+	for _, match := range matches {
+		if match.PathPrefix == "" && match.PathRegex == "" && len(match.Methods) == 0 {
+			return nil, fmt.Errorf("empty %s match", name)
+		}
+		matcher := requestMatch{prefix: match.PathPrefix, methods: upperSet(match.Methods)}
+		if match.PathRegex != "" {
+			regex, err := regexp.Compile(match.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s pathRegex `%s': %w", name, match.PathRegex, err)
+			}
+			matcher.regex = regex
+		}
+		parsed = append(parsed, matcher)
+	}
+	return parsed, nil
+}
+
+// matches reports whether req matches.
+func (m requestMatch) matches(req *http.Request) bool {
+	if len(m.methods) > 0 && !m.methods[req.Method] {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, m.prefix) {
+		return false
+	}
+	return m.regex == nil || m.regex.MatchString(req.URL.Path)
+}
+
+// rulesApply reports whether the access rules apply to req: it matches one of the rulesScope
+// matches, when there are any, and none of the rulesExceptions.
+func (mw *TraefikGeoIP2) rulesApply(req *http.Request) bool {
+	for _, match := range mw.ruleExceptions {
+		if match.matches(req) {
+			return false
+		}
+	}
+	if len(mw.ruleScope) == 0 {
+		return true
+	}
+	for _, match := range mw.ruleScope {
+		if match.matches(req) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package traefikgeoip2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+)
+
+// sign sets the signature header to the HMAC-SHA256 with signatureSecret of the values set
+// in header, as `Name: value` lines sorted by canonical header name.
+func (mw *TraefikGeoIP2) sign(header http.Header, values []geoValue) {
+	var names []string
+	if mw.output != OutputJSON {
+		for _, value := range values {
+			if header.Get(value.header) != "" {
+				names = append(names, http.CanonicalHeaderKey(value.header))
+			}
+		}
+	}
+	if mw.output != OutputHeaders {
+		names = append(names, http.CanonicalHeaderKey(mw.header(JSONHeader)))
+	}
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, mw.signatureSecret)
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		mac.Write([]byte(name + ": " + header.Get(name) + "\n"))
+	}
+	header.Set(mw.header(SignatureHeader), hex.EncodeToString(mac.Sum(nil)))
+}
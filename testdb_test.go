@@ -0,0 +1,303 @@
+package traefikgeoip2_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testNode is a node of the search tree built by writeTestDB.
+type testNode struct {
+	children [2]*testNode
+	data     []int // index into the data records per branch, -1 when empty
+}
+
+// writeTestDB writes a minimal MaxMind DB with the given database type and
+// network -> record mapping into dir and returns the path to the file.
+// Record values may be string, bool, uint16, uint32, uint64, float64,
+// []interface{}, map[string]interface{} and testPointer.
+func writeTestDB(t *testing.T, dir, name, dbType string, networks map[string]interface{}) string {
+	t.Helper()
+
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	root := &testNode{data: []int{-1, -1}}
+	var records [][]byte
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("invalid test network %s: %v", cidr, err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if bits == 32 {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		insertTestNetwork(root, ip, ones, i)
+		records = append(records, encodeTestValue(networks[cidr]))
+	}
+
+	nodes := []*testNode{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	index := map[*testNode]int{}
+	for i, node := range nodes {
+		index[node] = i
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(records))
+	for i, record := range records {
+		offsets[i] = data.Len()
+		data.Write(record)
+	}
+
+	var tree bytes.Buffer
+	nodeCount := len(nodes)
+	for _, node := range nodes {
+		for branch := 0; branch < 2; branch++ {
+			value := nodeCount
+			switch {
+			case node.children[branch] != nil:
+				value = index[node.children[branch]]
+			case node.data[branch] >= 0:
+				value = nodeCount + 16 + offsets[node.data[branch]]
+			}
+			_ = binary.Write(&tree, binary.BigEndian, uint32(value))
+		}
+	}
+
+	var out bytes.Buffer
+	out.Write(tree.Bytes())
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	out.Write(encodeTestValue(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1600000000),
+		"database_type":               dbType,
+		"description":                 map[string]interface{}{"en": "Test database"},
+		"ip_version":                  uint16(6),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(32),
+	}))
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, out.Bytes(), 0o600); err != nil {
+		t.Fatalf("unable to write test database: %v", err)
+	}
+	return path
+}
+
+func insertTestNetwork(node *testNode, ip net.IP, prefix, record int) {
+	for depth := 0; depth < prefix; depth++ {
+		branch := int(ip[depth/8]>>(7-uint(depth%8))) & 1
+		if depth == prefix-1 {
+			node.data[branch] = record
+			return
+		}
+		if node.children[branch] == nil {
+			node.children[branch] = &testNode{data: []int{-1, -1}}
+		}
+		node = node.children[branch]
+	}
+}
+
+func encodeTestControl(buf *bytes.Buffer, dataType byte, size int) {
+	first := byte(0)
+	if dataType <= 7 {
+		first = dataType << 5
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		first |= 30
+		extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		first |= 31
+		extra = []byte{byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+	}
+	buf.WriteByte(first)
+	if dataType > 7 {
+		buf.WriteByte(dataType - 7)
+	}
+	buf.Write(extra)
+}
+
+func encodeTestUint(buf *bytes.Buffer, dataType byte, value uint64, width int) {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, value)
+	raw = raw[8-width:]
+	for len(raw) > 0 && raw[0] == 0 {
+		raw = raw[1:]
+	}
+	encodeTestControl(buf, dataType, len(raw))
+	buf.Write(raw)
+}
+
+// testPointer a pointer to an offset below 2048 in the data section.
+type testPointer uint16
+
+func encodeTestValue(value interface{}) []byte {
+	var buf bytes.Buffer
+	switch v := value.(type) {
+	case string:
+		encodeTestControl(&buf, 2, len(v))
+		buf.WriteString(v)
+	case float64:
+		encodeTestControl(&buf, 3, 8)
+		_ = binary.Write(&buf, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		encodeTestUint(&buf, 5, uint64(v), 2)
+	case uint32:
+		encodeTestUint(&buf, 6, uint64(v), 4)
+	case uint64:
+		encodeTestUint(&buf, 9, v, 8)
+	case testPointer:
+		buf.Write([]byte{0x20 | byte(v>>8&7), byte(v)})
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		encodeTestControl(&buf, 14, size)
+	case []interface{}:
+		encodeTestControl(&buf, 11, len(v))
+		for _, item := range v {
+			buf.Write(encodeTestValue(item))
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encodeTestControl(&buf, 7, len(v))
+		for _, key := range keys {
+			buf.Write(encodeTestValue(key))
+			buf.Write(encodeTestValue(v[key]))
+		}
+	default:
+		panic("unsupported test value type")
+	}
+	return buf.Bytes()
+}
+
+// testCityRecord builds a City database record.
+func testCityRecord(country, region, city string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": country,
+			"names":    map[string]interface{}{"en": country},
+		},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"names": map[string]interface{}{"en": region}},
+		},
+		"city": map[string]interface{}{
+			"names": map[string]interface{}{"en": city},
+		},
+	}
+}
+
+// testCountryRecord builds a Country database record.
+func testCountryRecord(country string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": country,
+			"names":    map[string]interface{}{"en": country},
+		},
+	}
+}
+
+// writeTestIP2LocationDB writes a minimal IP2Location DB3 BIN file into dir and returns
+// the path to the file. Ranges maps the first IPv4 address of each range to its
+// country, region and city, a range ends where the next one starts.
+func writeTestIP2LocationDB(t *testing.T, dir, name string, ranges map[string][3]string) string {
+	t.Helper()
+
+	starts := make([]uint32, 0, len(ranges)+1)
+	values := map[uint32][3]string{}
+	for start, value := range ranges {
+		ip := net.ParseIP(start).To4()
+		if ip == nil {
+			t.Fatalf("invalid test address %s", start)
+		}
+		starts = append(starts, binary.BigEndian.Uint32(ip))
+		values[binary.BigEndian.Uint32(ip)] = value
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	starts = append(starts, math.MaxUint32)
+
+	const columns, headerSize = 4, 64
+	stringsStart := headerSize + len(starts)*columns*4
+	var table, text bytes.Buffer
+	for _, start := range starts {
+		_ = binary.Write(&table, binary.LittleEndian, start)
+		for _, value := range values[start] {
+			_ = binary.Write(&table, binary.LittleEndian, uint32(stringsStart+text.Len()))
+			text.WriteByte(byte(len(value)))
+			text.WriteString(value)
+		}
+		for i := len(values[start]); i < columns-1; i++ {
+			_ = binary.Write(&table, binary.LittleEndian, uint32(0))
+		}
+	}
+
+	header := make([]byte, headerSize)
+	header[0], header[1], header[2], header[3], header[4] = 3, columns, 20, 1, 1
+	binary.LittleEndian.PutUint32(header[5:], uint32(len(starts)))
+	binary.LittleEndian.PutUint32(header[9:], headerSize+1)
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, append(append(header, table.Bytes()...), text.Bytes()...), 0o600); err != nil {
+		t.Fatalf("unable to write test database: %v", err)
+	}
+	return path
+}
+
+// testArchive packs the database at path into a tar.gz the way MaxMind distributes it.
+func testArchive(t *testing.T, path string) []byte {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read test database: %v", err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	_ = archive.WriteHeader(&tar.Header{Name: "GeoLite2_20200101/", Typeflag: tar.TypeDir, Mode: 0o755})
+	_ = archive.WriteHeader(&tar.Header{Name: "GeoLite2_20200101/COPYRIGHT.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 4})
+	_, _ = archive.Write([]byte("test"))
+	_ = archive.WriteHeader(&tar.Header{
+		Name: "GeoLite2_20200101/" + filepath.Base(path), Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content)),
+	})
+	_, _ = archive.Write(content)
+	_ = archive.Close()
+	_ = gz.Close()
+	return buf.Bytes()
+}
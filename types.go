@@ -1,6 +1,7 @@
 package traefikgeoip2
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -11,57 +12,588 @@ import (
 // Unknown constant for undefined data.
 const Unknown = "XX"
 
+// Private constant for private addresses with skipPrivate.
+const Private = "PRIVATE"
+
 // DefaultDBPath default GeoIP2 database path.
 const DefaultDBPath = "GeoLite2-Country.mmdb"
 
+// Database types of the dbType option.
+const (
+	DBTypeAuto           = "auto"
+	DBTypeCity           = "city"
+	DBTypeCountry        = "country"
+	DBTypeASN            = "asn"
+	DBTypeISP            = "isp"
+	DBTypeAnonymousIP    = "anonymous-ip"
+	DBTypeConnectionType = "connection-type"
+	DBTypeEnterprise     = "enterprise"
+	DBTypeIP2Location    = "ip2location"
+	DBTypeCustom         = "custom"
+)
+
+// Database modes of the dbMode option.
+const (
+	DBModeMemory = "memory"
+	DBModeMmap   = "mmap"
+)
+
 // DefaultLogLevel default Level of errors.
 const DefaultLogLevel = "ERROR"
 
+// DefaultEditionID default MaxMind edition downloaded with a license key.
+const DefaultEditionID = "GeoLite2-Country"
+
+// DefaultDownloadURL default MaxMind database download service.
+const DefaultDownloadURL = "https://download.maxmind.com/geoip/databases"
+
+// DefaultUpdateInterval default interval between database downloads, MaxMind publishes weekly.
+const DefaultUpdateInterval = "168h"
+
+// DefaultRetryInterval default interval between attempts to open a database that failed at startup.
+const DefaultRetryInterval = "30s"
+
+// ReloadCooldown minimum interval between reloads of the reloadPath.
+const ReloadCooldown = time.Second
+
+// UpdateProtocolDownload downloads editions from the MaxMind download permalinks.
+const UpdateProtocolDownload = "download"
+
+// UpdateProtocolGeoIPUpdate updates editions with the protocol of the geoipupdate tool.
+const UpdateProtocolGeoIPUpdate = "geoipupdate"
+
+// DefaultUpdateURL default MaxMind update service of the geoipupdate protocol.
+const DefaultUpdateURL = "https://updates.maxmind.com"
+
+// SelectDepth selects the X-Forwarded-For hop by forwardedForDepth.
+const SelectDepth = "depth"
+
+// SelectFirstPublic selects the left-most public X-Forwarded-For hop.
+const SelectFirstPublic = "firstPublic"
+
+// SelectLast selects the right-most X-Forwarded-For hop.
+const SelectLast = "last"
+
+// IPStrategyCloudflare takes the client IP from Cloudflare.
+const IPStrategyCloudflare = "cloudflare"
+
+// IPStrategyFastly takes the client IP from Fastly.
+const IPStrategyFastly = "fastly"
+
+// IPStrategyAkamai takes the client IP from Akamai.
+const IPStrategyAkamai = "akamai"
+
+// IPStrategyCloudFront takes the client IP from Amazon CloudFront.
+const IPStrategyCloudFront = "cloudfront"
+
+// IPStrategyAuto takes the client IP from any of the supported CDNs.
+const IPStrategyAuto = "auto"
+
+// InvalidAddrUnknown sets unknown values for requests without a client IP.
+const InvalidAddrUnknown = "unknown"
+
+// InvalidAddrSkip sets no headers for requests without a client IP.
+const InvalidAddrSkip = "skip"
+
+// InvalidAddrPrivate sets private values for requests without a client IP.
+const InvalidAddrPrivate = "private"
+
+// InvalidAddrFallback looks up invalidAddrIp for requests without a client IP.
+const InvalidAddrFallback = "fallback"
+
+// SpoofIgnore ignores client IP headers of requests not from trustedProxies.
+const SpoofIgnore = "ignore"
+
+// SpoofFlag uses client IP headers of requests not from trustedProxies, but flags them.
+const SpoofFlag = "flag"
+
+// RegionFormatName sets subdivision names in the region headers.
+const RegionFormatName = "name"
+
+// RegionFormatCode sets ISO 3166-2 subdivision codes in the region headers.
+const RegionFormatCode = "code"
+
+// UnknownPlaceholder sets unknown values as Unknown.
+const UnknownPlaceholder = "placeholder"
+
+// UnknownOmit removes the headers of unknown values.
+const UnknownOmit = "omit"
+
+// CountryFormatAlpha2 sets two-letter ISO 3166-1 country codes, e.g. `DE`.
+const CountryFormatAlpha2 = "alpha2"
+
+// CountryFormatAlpha3 sets three-letter ISO 3166-1 country codes, e.g. `DEU`.
+const CountryFormatAlpha3 = "alpha3"
+
+// SourceDB result looked up in the databases.
+const SourceDB = "db"
+
+// SourceCache result from the cache of earlier lookups.
+const SourceCache = "cache"
+
+// SourceOverride result from the overrides or the override database.
+const SourceOverride = "override"
+
+// SourceFallback result from the built-in fallback dataset.
+const SourceFallback = "fallback"
+
+// SourcePrivate result for private addresses with skipPrivate.
+const SourcePrivate = "private"
+
+// SourceNone no result, the address was invalid, not found or no database was open.
+const SourceNone = "none"
+
+// CountryMapDefault key of the countryMaps value of all other countries.
+const CountryMapDefault = "*"
+
+// LanguageHintHeader sets the language of the country in X-Suggested-Language.
+const LanguageHintHeader = "header"
+
+// LanguageHintAcceptLanguage sets the language of the country in Accept-Language when the
+// client sent none.
+const LanguageHintAcceptLanguage = "acceptLanguage"
+
+// CaseUpper sets codes in upper case.
+const CaseUpper = "upper"
+
+// CaseLower sets codes in lower case.
+const CaseLower = "lower"
+
+// NameEncodingUTF8 sets names as raw UTF-8.
+const NameEncodingUTF8 = "utf8"
+
+// NameEncodingPercent percent-encodes names, e.g. `Z%C3%BCrich`.
+const NameEncodingPercent = "percent"
+
+// NameEncodingASCII transliterates names to ASCII, e.g. `Zurich`.
+const NameEncodingASCII = "ascii"
+
+// NameEncodingRFC8187 encodes names as RFC 8187 ext-value, e.g. `UTF-8”Z%C3%BCrich`.
+const NameEncodingRFC8187 = "rfc8187"
+
+// OutputHeaders sets a header per value.
+const OutputHeaders = "headers"
+
+// OutputJSON sets all values in the JSON header.
+const OutputJSON = "json"
+
+// OutputBoth sets a header per value and the JSON header.
+const OutputBoth = "both"
+
+// DefaultLocale default locale of place names.
+const DefaultLocale = "en"
+
+// DefaultCoordinatePrecision default number of decimals of the latitude and longitude.
+const DefaultCoordinatePrecision = 4
+
+// DefaultSubdivisionSeparator default separator of the subdivisions.
+const DefaultSubdivisionSeparator = "/"
+
+// GeofenceAllow only passes on requests of clients within one of the allow geofences.
+const GeofenceAllow = "allow"
+
+// GeofenceBlock blocks requests of clients within the geofence.
+const GeofenceBlock = "block"
+
+// LookupErrorAllow passes requests on without applying the access rules when no database
+// is open or the lookup fails.
+const LookupErrorAllow = "allow"
+
+// LookupErrorBlock applies the access rules to the unknown location when no database is
+// open or the lookup fails.
+const LookupErrorBlock = "block"
+
+// BlockActionReject responds to blocked requests with the blockStatus and blockBody.
+const BlockActionReject = "reject"
+
+// BlockActionRedirect redirects blocked requests to the blockRedirectUrl.
+const BlockActionRedirect = "redirect"
+
+// BlockActionTag passes blocked requests on with the reason in X-GeoIP2-Blocked.
+const BlockActionTag = "tag"
+
+// DefaultBlockContentType default content type of the blockBody.
+const DefaultBlockContentType = "text/plain; charset=utf-8"
+
+// DefaultBlockTemplateContentType default content type of the blockTemplate.
+const DefaultBlockTemplateContentType = "text/html; charset=utf-8"
+
+// DefaultMaxValueLength default maximum length in bytes of names and field values.
+const DefaultMaxValueLength = 256
+
+// MaxGeoHashPrecision maximum number of characters of the geohash.
+const MaxGeoHashPrecision = 12
+
+// DefaultS3Region default region of S3 buckets.
+const DefaultS3Region = "us-east-1"
+
+// DefaultDownloadTimeout default timeout of a database download.
+const DefaultDownloadTimeout = 5 * time.Minute
+
 const DefaultCacheExpire = 30 * time.Minute
 const DefaultCachePurge = 2 * time.Hour
 
 // DefaultCacheExpire is Default purges Time
 
+// HeaderPrefix prefix of the headers set by the plugin.
+const HeaderPrefix = "X-GeoIP2-"
+
 const (
 	// RealIPHeader real ip header.
 	RealIPHeader = "X-Real-IP"
+	// ForwardedForHeader forwarded for header.
+	ForwardedForHeader = "X-Forwarded-For"
+	// AcceptLanguageHeader accept language header.
+	AcceptLanguageHeader = "Accept-Language"
+	// RetryAfterHeader retry after header.
+	RetryAfterHeader = "Retry-After"
+	// LinkHeader link header of the blockedBy relation.
+	LinkHeader = "Link"
+	// SuggestedLanguageHeader language of the country header name.
+	SuggestedLanguageHeader = "X-Suggested-Language"
+	// DebugSecretHeader header with the secret of a debug IP override.
+	DebugSecretHeader = "X-GeoIP2-Debug-Secret"
+	// DebugSecretParam query parameter removed from requests, the secret of a debug IP
+	// override is not accepted in the query.
+	DebugSecretParam = "geoip2Secret"
+	// ReloadSecretHeader header with the reloadSecret of reloadPath requests.
+	ReloadSecretHeader = "X-GeoIP2-Reload-Secret"
 	// CountryHeader country header name.
 	CountryHeader = "X-GeoIP2-Country"
 	// RegionHeader region header name.
 	RegionHeader = "X-GeoIP2-Region"
 	// CityHeader city header name.
 	CityHeader = "X-GeoIP2-City"
+	// ASNHeader autonomous system number header name.
+	ASNHeader = "X-GeoIP2-ASN"
+	// ASOrgHeader autonomous system organization header name.
+	ASOrgHeader = "X-GeoIP2-AS-Org"
+	// ISPHeader ISP name header name.
+	ISPHeader = "X-GeoIP2-ISP"
+	// OrganizationHeader organization header name.
+	OrganizationHeader = "X-GeoIP2-Organization"
+	// ConnectionTypeHeader connection type header name.
+	ConnectionTypeHeader = "X-GeoIP2-Connection-Type"
+	// CountryConfidenceHeader country confidence header name.
+	CountryConfidenceHeader = "X-GeoIP2-Country-Confidence"
+	// CityConfidenceHeader city confidence header name.
+	CityConfidenceHeader = "X-GeoIP2-City-Confidence"
+	// MCCHeader mobile country code header name.
+	MCCHeader = "X-GeoIP2-Mobile-Country-Code"
+	// MNCHeader mobile network code header name.
+	MNCHeader = "X-GeoIP2-Mobile-Network-Code"
+	// RegionConfidenceHeader region confidence header name.
+	RegionConfidenceHeader = "X-GeoIP2-Region-Confidence"
+	// UserTypeHeader user type header name.
+	UserTypeHeader = "X-GeoIP2-User-Type"
+	// IsAnonymousHeader anonymous network header name.
+	IsAnonymousHeader = "X-GeoIP2-Is-Anonymous"
+	// IsVPNHeader anonymous VPN header name.
+	IsVPNHeader = "X-GeoIP2-Is-VPN"
+	// IsTorExitHeader Tor exit node header name.
+	IsTorExitHeader = "X-GeoIP2-Is-Tor-Exit"
+	// IsHostingHeader hosting provider header name.
+	IsHostingHeader = "X-GeoIP2-Is-Hosting"
+	// IsPublicProxyHeader public proxy header name.
+	IsPublicProxyHeader = "X-GeoIP2-Is-Public-Proxy"
+	// IsResidentialProxyHeader residential proxy header name.
+	IsResidentialProxyHeader = "X-GeoIP2-Is-Residential-Proxy"
+	// IsAnonymousProxyHeader legacy anonymous proxy trait header name.
+	IsAnonymousProxyHeader = "X-GeoIP2-Is-Anonymous-Proxy"
+	// IsSatelliteProviderHeader legacy satellite provider trait header name.
+	IsSatelliteProviderHeader = "X-GeoIP2-Is-Satellite-Provider"
+	// IsAnycastHeader anycast network header name.
+	IsAnycastHeader = "X-GeoIP2-Is-Anycast"
+	// StaleHeader stale database header name.
+	StaleHeader = "X-GeoIP2-DB-Stale"
+	// NetworkHeader matched network header name.
+	NetworkHeader = "X-GeoIP2-Network"
+	// SourceHeader subsystem that produced the result header name.
+	SourceHeader = "X-GeoIP2-Source"
+	// CountryNameHeader country name header name.
+	CountryNameHeader = "X-GeoIP2-Country-Name"
+	// ContinentHeader continent code header name.
+	ContinentHeader = "X-GeoIP2-Continent"
+	// RegisteredCountryHeader country the address is registered in header name.
+	RegisteredCountryHeader = "X-GeoIP2-Registered-Country"
+	// RepresentedCountryHeader country represented by the users of the address header name.
+	RepresentedCountryHeader = "X-GeoIP2-Represented-Country"
+	// CurrencyHeader currency of the country header name.
+	CurrencyHeader = "X-GeoIP2-Currency"
+	// CallingCodeHeader telephone calling code of the country header name.
+	CallingCodeHeader = "X-GeoIP2-Calling-Code"
+	// Region2Header second level subdivision header name.
+	Region2Header = "X-GeoIP2-Region2"
+	// SubdivisionsHeader all subdivisions header name.
+	SubdivisionsHeader = "X-GeoIP2-Subdivisions"
+	// LatitudeHeader latitude header name.
+	LatitudeHeader = "X-GeoIP2-Latitude"
+	// LongitudeHeader longitude header name.
+	LongitudeHeader = "X-GeoIP2-Longitude"
+	// AccuracyRadiusHeader accuracy radius of the coordinates header name.
+	AccuracyRadiusHeader = "X-GeoIP2-Accuracy-Radius"
+	// MetroCodeHeader US metro code header name.
+	MetroCodeHeader = "X-GeoIP2-Metro-Code"
+	// GeoHashHeader geohash of the coordinates header name.
+	GeoHashHeader = "X-GeoIP2-GeoHash"
+	// LocalTimeHeader local time of the client header name.
+	LocalTimeHeader = "X-GeoIP2-Local-Time"
+	// DistanceHeader distance to distanceFrom header name.
+	DistanceHeader = "X-GeoIP2-Distance-Km"
+	// ZoneHeader geoZonesPath zone of the coordinates header name.
+	ZoneHeader = "X-GeoIP2-Zone"
+	// JSONHeader header with all values as JSON.
+	JSONHeader = "X-GeoIP2-JSON"
+	// PeerCountryHeader country of the connection peer header name.
+	PeerCountryHeader = "X-GeoIP2-Peer-Country"
+	// PeerRegionHeader region of the connection peer header name.
+	PeerRegionHeader = "X-GeoIP2-Peer-Region"
+	// PeerCityHeader city of the connection peer header name.
+	PeerCityHeader = "X-GeoIP2-Peer-City"
+	// PeerASNHeader autonomous system number of the connection peer header name.
+	PeerASNHeader = "X-GeoIP2-Peer-ASN"
+	// SpoofSuspectedHeader header flagging client IPs not vouched for by a trusted proxy.
+	SpoofSuspectedHeader = "X-GeoIP2-Spoof-Suspected"
+	// DBInfoHeader database debug response header name.
+	DBInfoHeader = "X-GeoIP2-DB-Info"
+	// DurationHeader lookup duration debug response header name.
+	DurationHeader = "X-GeoIP2-Duration-Us"
+	// SignatureHeader HMAC of the geo headers header name.
+	SignatureHeader = "X-GeoIP2-Signature"
+	// BlockedHeader reason of blocking with the tag blockAction header name.
+	BlockedHeader = "X-GeoIP2-Blocked"
 )
 
 // GeoIPResult GeoIPResult.
 type GeoIPResult struct {
-	country string
-	region  string
-	city    string
+	continent        string
+	country          string
+	registered       string
+	represented      string
+	region           string
+	regionCode       string
+	region2          string
+	region2Code      string
+	subdivisions     []string
+	subdivisionCodes []string
+	city             string
+	asn              uint32
+	asOrg            string
+	isp              string
+	organization     string
+	connectionType   string
+	anonymous        *geoip2.AnonymousIP
+	traits           *traitFlags
+	location         *geoip2.Location
+	names            *placeNames
+
+	countryConfidence uint16
+	regionConfidence  uint16
+	cityConfidence    uint16
+	userType          string
+	mcc               string
+	mnc               string
+
+	fields  map[string]string // header name -> value of the configured record fields
+	source  string
+	network string
+	failed  bool // no database was open or the lookup failed, not found addresses aside
+}
+
+// Continent returns the code of the continent, e.g. `EU`, the one of the country when
+// the database has none, "" when not found.
+func (r *GeoIPResult) Continent() string {
+	if r.continent == "" {
+		return countryContinents[r.country]
+	}
+	return r.continent
+}
+
+// Country returns the ISO code of the country, Unknown when not found.
+func (r *GeoIPResult) Country() string { return r.country }
+
+// RegisteredCountry returns the ISO code of the country the address is registered in.
+func (r *GeoIPResult) RegisteredCountry() string { return r.registered }
+
+// RepresentedCountry returns the ISO code of the country represented by the users of the
+// address, e.g. for military bases abroad.
+func (r *GeoIPResult) RepresentedCountry() string { return r.represented }
+
+// Region returns the name of the largest subdivision, Unknown when not found.
+func (r *GeoIPResult) Region() string { return r.region }
+
+// RegionCode returns the ISO 3166-2 code of the largest subdivision, e.g. `US-CA`.
+func (r *GeoIPResult) RegionCode() string { return r.regionCode }
+
+// Subdivisions returns the names of all subdivisions, the largest first.
+func (r *GeoIPResult) Subdivisions() []string { return r.subdivisions }
+
+// City returns the name of the city, Unknown when not found.
+func (r *GeoIPResult) City() string { return r.city }
+
+// ASN returns the autonomous system number, 0 when not looked up.
+func (r *GeoIPResult) ASN() uint32 { return r.asn }
+
+// ASOrg returns the organization of the autonomous system.
+func (r *GeoIPResult) ASOrg() string { return r.asOrg }
+
+// ISP returns the name of the ISP.
+func (r *GeoIPResult) ISP() string { return r.isp }
+
+// Organization returns the name of the organization.
+func (r *GeoIPResult) Organization() string { return r.organization }
+
+// ConnectionType returns the connection type, e.g. `Cable/DSL`.
+func (r *GeoIPResult) ConnectionType() string { return r.connectionType }
+
+// Location returns the coordinates of the address, false when the database has none.
+func (r *GeoIPResult) Location() (geoip2.Location, bool) {
+	if r.location == nil {
+		return geoip2.Location{}, false
+	}
+	return *r.location, true
+}
+
+// Anonymous returns the Anonymous-IP flags, false when no Anonymous-IP database has been looked up.
+func (r *GeoIPResult) Anonymous() (geoip2.AnonymousIP, bool) {
+	if r.anonymous == nil {
+		return geoip2.AnonymousIP{}, false
+	}
+	return *r.anonymous, true
 }
 
+// Network returns the network of the database the address matched, e.g. `81.2.69.0/24`.
+func (r *GeoIPResult) Network() string { return r.network }
+
+// Source returns the subsystem that produced the result, e.g. SourceDB or SourceCache.
+func (r *GeoIPResult) Source() string { return r.source }
+
+// Field returns the value of the configured field of header.
+func (r *GeoIPResult) Field(header string) string { return r.fields[header] }
+
+// traitFlags the trait flags of City and Country records.
+type traitFlags struct {
+	anonymousProxy    bool
+	satelliteProvider bool
+	anycast           bool
+}
+
+// placeNames the names of the country, region and city by locale.
+type placeNames struct {
+	country map[string]string
+	region  map[string]string
+	city    map[string]string
+}
+
+// recordParts the parts of City and Enterprise records extracted into the results, the
+// region with the subdivisions and the city. Parts no value, rule or template uses are
+// left out.
+type recordParts struct {
+	region bool
+	city   bool
+}
+
+// allParts extracts the records in full.
+var allParts = recordParts{region: true, city: true}
+
 // LookupGeoIP2 LookupGeoIP2.
 type LookupGeoIP2 func(ip net.IP) (*GeoIPResult, error)
 
 // CreateCityDBLookup CreateCityDBLookup.
 func CreateCityDBLookup(rdr *geoip2.CityReader) LookupGeoIP2 {
+	return createCityDBLookup(rdr, allParts)
+}
+
+// createCityDBLookup creates the lookup of the City reader extracting parts of the records.
+func createCityDBLookup(rdr *geoip2.CityReader, parts recordParts) LookupGeoIP2 {
 	return func(ip net.IP) (*GeoIPResult, error) {
 		rec, err := rdr.Lookup(ip)
 		if err != nil {
 			return nil, fmt.Errorf("%w", err)
 		}
-		retval := GeoIPResult{
-			country: rec.Country.ISOCode,
-			region:  Unknown,
-			city:    rec.City.Names["en"],
+		retval := newCityResult(rec, parts)
+		return &retval, nil
+	}
+}
+
+// CreateEnterpriseDBLookup CreateEnterpriseDBLookup.
+func CreateEnterpriseDBLookup(rdr *geoip2.CityReader) LookupGeoIP2 {
+	return createEnterpriseDBLookup(rdr, allParts)
+}
+
+// createEnterpriseDBLookup creates the lookup of the Enterprise reader extracting parts of
+// the records.
+func createEnterpriseDBLookup(rdr *geoip2.CityReader, parts recordParts) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		rec, err := rdr.Lookup(ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
 		}
-		if rec.Subdivisions != nil {
-			retval.region = rec.Subdivisions[0].Names["en"]
+		retval := newCityResult(rec, parts)
+		retval.asn = rec.Traits.AutonomousSystemNumber
+		retval.asOrg = rec.Traits.AutonomousSystemOrganization
+		retval.isp = rec.Traits.ISP
+		retval.organization = rec.Traits.Organization
+		retval.connectionType = rec.Traits.ConnectionType
+		retval.countryConfidence = rec.Country.Confidence
+		retval.cityConfidence = rec.City.Confidence
+		if len(rec.Subdivisions) > 0 {
+			retval.regionConfidence = rec.Subdivisions[0].Confidence
 		}
+		retval.userType = rec.Traits.UserType
 		return &retval, nil
 	}
 }
 
+// newCityResult builds the result of a City or Enterprise record with its parts.
+func newCityResult(rec *geoip2.CityResult, parts recordParts) GeoIPResult {
+	retval := GeoIPResult{
+		continent:   rec.Continent.Code,
+		country:     rec.Country.ISOCode,
+		registered:  rec.RegisteredCountry.ISOCode,
+		represented: rec.RepresentedCountry.ISOCode,
+		region:      Unknown,
+	}
+	retval.names = &placeNames{country: rec.Country.Names}
+	retval.traits = &traitFlags{
+		anonymousProxy:    rec.Traits.IsAnonymousProxy,
+		satelliteProvider: rec.Traits.IsSatelliteProvider,
+	}
+	if parts.city {
+		retval.city = rec.City.Names["en"]
+		retval.names.city = rec.City.Names
+	}
+	if rec.Location != (geoip2.Location{}) {
+		location := rec.Location
+		retval.location = &location
+	}
+	if !parts.region {
+		return retval
+	}
+	if rec.Subdivisions != nil {
+		retval.names.region = rec.Subdivisions[0].Names
+		retval.region = rec.Subdivisions[0].Names["en"]
+		retval.regionCode = subdivisionCode(rec.Country.ISOCode, rec.Subdivisions[0])
+	}
+	if len(rec.Subdivisions) > 1 {
+		retval.region2 = rec.Subdivisions[1].Names["en"]
+		retval.region2Code = subdivisionCode(rec.Country.ISOCode, rec.Subdivisions[1])
+	}
+	for _, subdivision := range rec.Subdivisions {
+		retval.subdivisions = append(retval.subdivisions, subdivision.Names["en"])
+		retval.subdivisionCodes = append(retval.subdivisionCodes, subdivisionCode(rec.Country.ISOCode, subdivision))
+	}
+	return retval
+}
+
+// subdivisionCode returns the ISO 3166-2 code of a subdivision, e.g. US-CA.
+func subdivisionCode(country string, subdivision geoip2.Subdivision) string {
+	if country == "" || subdivision.ISOCode == "" {
+		return ""
+	}
+	return country + "-" + subdivision.ISOCode
+}
+
 // CreateCountryDBLookup CreateCountryDBLookup.
 func CreateCountryDBLookup(rdr *geoip2.CountryReader) LookupGeoIP2 {
 	return func(ip net.IP) (*GeoIPResult, error) {
@@ -70,10 +602,203 @@ func CreateCountryDBLookup(rdr *geoip2.CountryReader) LookupGeoIP2 {
 			return nil, fmt.Errorf("%w", err)
 		}
 		retval := GeoIPResult{
-			country: rec.Country.ISOCode,
-			region:  Unknown,
-			city:    Unknown,
+			continent:   rec.Continent.Code,
+			country:     rec.Country.ISOCode,
+			registered:  rec.RegisteredCountry.ISOCode,
+			represented: rec.RepresentedCountry.ISOCode,
+			region:      Unknown,
+			city:        Unknown,
+			names:       &placeNames{country: rec.Country.Names},
+			traits: &traitFlags{
+				anonymousProxy:    rec.Traits.IsAnonymousProxy,
+				satelliteProvider: rec.Traits.IsSatelliteProvider,
+			},
+		}
+		return &retval, nil
+	}
+}
+
+// CreateASNDBLookup CreateASNDBLookup.
+func CreateASNDBLookup(rdr *geoip2.ASNReader) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		rec, err := rdr.Lookup(ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		retval := GeoIPResult{
+			asn:   rec.AutonomousSystemNumber,
+			asOrg: rec.AutonomousSystemOrganization,
+		}
+		return &retval, nil
+	}
+}
+
+// CreateISPDBLookup CreateISPDBLookup.
+func CreateISPDBLookup(rdr *geoip2.ISPReader) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		rec, err := rdr.Lookup(ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		retval := GeoIPResult{
+			asn:          rec.AutonomousSystemNumber,
+			asOrg:        rec.AutonomousSystemOrganization,
+			isp:          rec.ISP,
+			organization: rec.Organization,
+		}
+		return &retval, nil
+	}
+}
+
+// CreateConnectionTypeDBLookup CreateConnectionTypeDBLookup.
+func CreateConnectionTypeDBLookup(rdr *geoip2.ConnectionTypeReader) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		connectionType, err := rdr.Lookup(ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		retval := GeoIPResult{
+			connectionType: connectionType,
+		}
+		return &retval, nil
+	}
+}
+
+// CreateAnonymousIPDBLookup CreateAnonymousIPDBLookup.
+// Addresses missing from the database are reported as not anonymous.
+func CreateAnonymousIPDBLookup(rdr *geoip2.AnonymousIPReader) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		rec, err := rdr.Lookup(ip)
+		if errors.Is(err, geoip2.ErrNotFound) {
+			rec, err = &geoip2.AnonymousIP{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		retval := GeoIPResult{
+			anonymous: rec,
 		}
 		return &retval, nil
 	}
 }
+
+// MergeLookups runs every lookup and combines the results.
+// Earlier lookups take precedence, later ones only fill in unknown values.
+func MergeLookups(lookups ...LookupGeoIP2) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		var (
+			retval  *GeoIPResult
+			lastErr error
+		)
+		for _, lookup := range lookups {
+			rec, err := lookup(ip)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if retval == nil {
+				merged := *rec
+				retval = &merged
+				continue
+			}
+			retval.merge(rec)
+		}
+		if retval == nil {
+			return nil, lastErr
+		}
+		return retval, nil
+	}
+}
+
+// sourceLookup sets source as the source of the results of lookup, nil when lookup is nil.
+func sourceLookup(source string, lookup LookupGeoIP2) LookupGeoIP2 {
+	if lookup == nil {
+		return nil
+	}
+	return func(ip net.IP) (*GeoIPResult, error) {
+		rec, err := lookup(ip)
+		if err == nil {
+			rec.source = source
+		}
+		return rec, err
+	}
+}
+
+// OverrideLookup answers from override and from lookup, which may be nil, for addresses
+// override has no entry for. An override result is used as is, not merged.
+func OverrideLookup(override, lookup LookupGeoIP2) LookupGeoIP2 {
+	return func(ip net.IP) (*GeoIPResult, error) {
+		rec, err := override(ip)
+		if err == nil || lookup == nil {
+			return rec, err
+		}
+		return lookup(ip)
+	}
+}
+
+// merge fills the values of r that are not known yet from other.
+func (r *GeoIPResult) merge(other *GeoIPResult) {
+	if r.continent == "" {
+		r.continent = other.continent
+	}
+	r.country = mergeValue(r.country, other.country)
+	r.registered = mergeValue(r.registered, other.registered)
+	r.represented = mergeValue(r.represented, other.represented)
+	if r.region == "" || r.region == Unknown {
+		r.regionCode, r.region2, r.region2Code = other.regionCode, other.region2, other.region2Code
+		r.subdivisions, r.subdivisionCodes = other.subdivisions, other.subdivisionCodes
+	}
+	r.region = mergeValue(r.region, other.region)
+	r.city = mergeValue(r.city, other.city)
+	if r.asn == 0 {
+		r.asn = other.asn
+	}
+	r.asOrg = mergeValue(r.asOrg, other.asOrg)
+	if r.network == "" {
+		r.network = other.network
+	}
+	r.isp = mergeValue(r.isp, other.isp)
+	r.organization = mergeValue(r.organization, other.organization)
+	r.connectionType = mergeValue(r.connectionType, other.connectionType)
+	if r.anonymous == nil {
+		r.anonymous = other.anonymous
+	}
+	if r.traits == nil {
+		r.traits = other.traits
+	}
+	if r.location == nil {
+		r.location = other.location
+	}
+	if r.names == nil {
+		r.names = other.names
+	}
+	if r.countryConfidence == 0 {
+		r.countryConfidence = other.countryConfidence
+	}
+	if r.regionConfidence == 0 {
+		r.regionConfidence = other.regionConfidence
+	}
+	if r.cityConfidence == 0 {
+		r.cityConfidence = other.cityConfidence
+	}
+	r.userType = mergeValue(r.userType, other.userType)
+	r.mcc = mergeValue(r.mcc, other.mcc)
+	r.mnc = mergeValue(r.mnc, other.mnc)
+	if len(other.fields) > 0 {
+		fields := make(map[string]string, len(r.fields)+len(other.fields))
+		for header, value := range other.fields {
+			fields[header] = value
+		}
+		for header, value := range r.fields {
+			fields[header] = value
+		}
+		r.fields = fields
+	}
+}
+
+func mergeValue(value, other string) string {
+	if value == "" || value == Unknown {
+		return other
+	}
+	return value
+}
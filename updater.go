@@ -0,0 +1,236 @@
+package traefikgeoip2
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// updater downloads a database from a remote source into a local file.
+type updater struct {
+	client     *http.Client
+	url        string
+	accountID  string
+	licenseKey string
+	archive    bool
+	md5        bool
+	path       string
+	authorize  func(*http.Request)
+
+	mu   sync.Mutex
+	etag string
+}
+
+// newMaxMindUpdater downloads the configured edition from MaxMind with an account ID and license key.
+func newMaxMindUpdater(cfg *Config) *updater {
+	if cfg.UpdateProtocol == UpdateProtocolGeoIPUpdate {
+		return &updater{
+			client:     &http.Client{Timeout: DefaultDownloadTimeout},
+			url:        strings.TrimSuffix(cfg.UpdateURL, "/") + "/geoip/databases/" + cfg.EditionID + "/update",
+			accountID:  cfg.AccountID,
+			licenseKey: cfg.LicenseKey,
+			md5:        true,
+			path:       filepath.Join(downloadDir(cfg), cfg.EditionID+".mmdb"),
+		}
+	}
+	return &updater{
+		client:     &http.Client{Timeout: DefaultDownloadTimeout},
+		url:        strings.TrimSuffix(cfg.DownloadURL, "/") + "/" + cfg.EditionID + "/download?suffix=tar.gz",
+		accountID:  cfg.AccountID,
+		licenseKey: cfg.LicenseKey,
+		archive:    true,
+		path:       filepath.Join(downloadDir(cfg), cfg.EditionID+".mmdb"),
+	}
+}
+
+// newURLUpdater downloads the mmdb file rawURL points to, from a web server or an object store.
+func newURLUpdater(cfg *Config, rawURL string) *updater {
+	name := "GeoIP2.mmdb"
+	if u, err := url.Parse(rawURL); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		name = path.Base(u.Path)
+	}
+	upd := &updater{
+		client: &http.Client{Timeout: DefaultDownloadTimeout},
+		url:    rawURL,
+		path:   filepath.Join(downloadDir(cfg), name),
+	}
+	if isObjectStore(rawURL) {
+		upd.url, upd.authorize = objectStoreRequest(cfg, rawURL)
+	}
+	return upd
+}
+
+// isRemote reports whether dbPath is a URL rather than a local file.
+func isRemote(dbPath string) bool {
+	return strings.HasPrefix(dbPath, "https://") || strings.HasPrefix(dbPath, "http://") || isObjectStore(dbPath)
+}
+
+func downloadDir(cfg *Config) string {
+	if cfg.DownloadDir == "" {
+		return os.TempDir()
+	}
+	return os.ExpandEnv(cfg.DownloadDir)
+}
+
+// update downloads the database if it is newer than the local copy.
+// It reports whether the local database has been replaced.
+func (u *updater) update() (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	rawURL := u.url
+	if u.md5 {
+		rawURL += "?db_md5=" + fileMD5(u.path)
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	if u.licenseKey != "" {
+		req.SetBasicAuth(u.accountID, u.licenseKey)
+	}
+	if info, err := os.Stat(u.path); err == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+		if u.etag != "" {
+			req.Header.Set("If-None-Match", u.etag)
+		}
+	}
+	if u.authorize != nil {
+		u.authorize(req)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	switch {
+	case u.archive:
+		err = extractTarGz(resp.Body, u.path)
+	case u.md5:
+		err = writeGzipVerified(u.path, resp.Body, resp.Header.Get("X-Database-MD5"))
+	default:
+		err = writeFileAtomic(u.path, resp.Body, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+	u.etag = resp.Header.Get("ETag")
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		_ = os.Chtimes(u.path, modified, modified)
+	}
+	return true, nil
+}
+
+// fileMD5 returns the MD5 digest of the file at path the way geoipupdate reports it,
+// zeros when there is no file yet.
+func fileMD5(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return strings.Repeat("0", 32)
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return strings.Repeat("0", 32)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeGzipVerified decompresses r to path if its MD5 digest matches expected.
+func writeGzipVerified(path string, r io.Reader, expected string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer gz.Close()
+
+	hash := md5.New()
+	return writeFileAtomic(path, io.TeeReader(gz, hash), func() error {
+		if actual := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(actual, expected) {
+			return fmt.Errorf("MD5 mismatch: expected %s, got %s", expected, actual)
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic writes r into a temporary file next to path and renames it over path.
+// The file is only renamed if verify, when not nil, accepts the content written.
+func writeFileAtomic(path string, r io.Reader, verify func() error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	if verify != nil {
+		if err := verify(); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// updateEvery runs the updater of db every interval plus a random delay up to jitter,
+// so that many instances do not download at the same time, and reloads the downloaded
+// database. It stops when ctx is done.
+func (db *database) updateEvery(ctx context.Context, interval, jitter time.Duration) {
+	for {
+		delay := interval
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			updated, err := db.upd.update()
+			if err != nil {
+				logWarn.Printf("GeoIP DB `%s' not updated: %v", db.path, err)
+				continue
+			}
+			if updated {
+				db.reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package traefikgeoip2_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mw "github.com/sopov/traefikgeoip2"
+)
+
+func TestGeoIPDownload(t *testing.T) {
+	archive := testArchive(t, writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	}))
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/GeoLite2-City/download" || req.URL.Query().Get("suffix") != "tar.gz" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "42" || pass != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		rw.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		_, _ = rw.Write(archive)
+	}))
+	defer server.Close()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.AccountID = "42"
+	mwCfg.LicenseKey = "secret"
+	mwCfg.EditionID = "GeoLite2-City"
+	mwCfg.DownloadDir = t.TempDir()
+	mwCfg.DownloadURL = server.URL
+	mwCfg.UpdateInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if atomic.LoadInt32(&downloads) != 1 {
+		t.Fatalf("Unmodified database must not be downloaded again, downloads: %d", downloads)
+	}
+}
+
+func TestGeoIPFromURL(t *testing.T) {
+	content, err := ioutil.ReadFile(writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	}))
+	if err != nil {
+		t.Fatalf("Unable to read DB: %v", err)
+	}
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/db/GeoLite2-City.mmdb" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = rw.Write(content)
+	}))
+	defer server.Close()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = server.URL + "/db/GeoLite2-City.mmdb"
+	mwCfg.DownloadDir = t.TempDir()
+	mwCfg.UpdateInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if atomic.LoadInt32(&downloads) != 1 {
+		t.Fatalf("Unmodified database must not be downloaded again, downloads: %d", downloads)
+	}
+}
+
+func TestGeoIPFromS3(t *testing.T) {
+	content, err := ioutil.ReadFile(writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	}))
+	if err != nil {
+		t.Fatalf("Unable to read DB: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if req.URL.Path != "/geo/weekly/GeoLite2-City.mmdb" ||
+			!strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+			!strings.Contains(auth, "/eu-central-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") ||
+			req.Header.Get("X-Amz-Date") == "" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = rw.Write(content)
+	}))
+	defer server.Close()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = "s3://geo/weekly/GeoLite2-City.mmdb"
+	mwCfg.S3Endpoint = server.URL
+	mwCfg.S3Region = "eu-central-1"
+	mwCfg.S3AccessKeyID = "AKIDEXAMPLE"
+	mwCfg.S3SecretAccessKey = "secret"
+	mwCfg.DownloadDir = t.TempDir()
+	mwCfg.FailOnError = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+}
+
+func geoipUpdateServer(t *testing.T, content []byte, sum string, downloads *int32) *httptest.Server {
+	t.Helper()
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/geoip/databases/GeoLite2-City/update" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "42" || pass != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("db_md5") == sum {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(downloads, 1)
+		rw.Header().Set("X-Database-MD5", sum)
+		_, _ = rw.Write(body.Bytes())
+	}))
+}
+
+func TestGeoIPUpdateProtocol(t *testing.T) {
+	content, err := ioutil.ReadFile(writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(content)
+
+	var downloads int32
+	server := geoipUpdateServer(t, content, hex.EncodeToString(sum[:]), &downloads)
+	defer server.Close()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.AccountID = "42"
+	mwCfg.LicenseKey = "secret"
+	mwCfg.EditionID = "GeoLite2-City"
+	mwCfg.DownloadDir = t.TempDir()
+	mwCfg.UpdateProtocol = mw.UpdateProtocolGeoIPUpdate
+	mwCfg.UpdateURL = server.URL
+	mwCfg.UpdateInterval = "10ms"
+	mwCfg.UpdateJitter = "5ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(ctx, next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CityHeader, "Munich")
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if atomic.LoadInt32(&downloads) != 1 {
+		t.Fatalf("Database with matching MD5 must not be downloaded again, downloads: %d", downloads)
+	}
+}
+
+func TestGeoIPUpdateProtocolMD5Mismatch(t *testing.T) {
+	content, err := ioutil.ReadFile(writeTestDB(t, t.TempDir(), "GeoLite2-City.mmdb", "GeoLite2-City", map[string]interface{}{
+		"188.193.88.0/24": testCityRecord("DE", "Bavaria", "Munich"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var downloads int32
+	server := geoipUpdateServer(t, content, strings.Repeat("f", 32), &downloads)
+	defer server.Close()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.AccountID = "42"
+	mwCfg.LicenseKey = "secret"
+	mwCfg.EditionID = "GeoLite2-City"
+	mwCfg.DownloadDir = t.TempDir()
+	mwCfg.UpdateProtocol = mw.UpdateProtocolGeoIPUpdate
+	mwCfg.UpdateURL = server.URL
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Must not fail on download error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+}
+
+func TestGeoIPDownloadUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.LicenseKey = "invalid"
+	mwCfg.DownloadDir = t.TempDir()
+	mwCfg.DownloadURL = server.URL
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Must not fail on download error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = ValidIPAndPort
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mw.CountryHeader, mw.Unknown)
+}
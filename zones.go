@@ -0,0 +1,118 @@
+package traefikgeoip2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// geoZone a named area of the geoZonesPath GeoJSON file.
+type geoZone struct {
+	name string
+	// polygons of rings of [longitude, latitude] positions, the first ring is the outer
+	// boundary and the others are holes.
+	polygons [][][][2]float64
+}
+
+// geoJSONFeature a GeoJSON Feature, or a FeatureCollection with its features.
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Features   []geoJSONFeature       `json:"features"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   *struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// loadGeoZones reads the Polygon and MultiPolygon features of the GeoJSON file at path,
+// named by their `name' property. It returns nil when path is empty.
+func loadGeoZones(path string) ([]geoZone, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read geoZonesPath: %w", err)
+	}
+	var root geoJSONFeature
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid geoZonesPath GeoJSON: %w", err)
+	}
+	features := root.Features
+	if root.Type == "Feature" {
+		features = []geoJSONFeature{root}
+	}
+
+	zones := make([]geoZone, 0, len(features))
+	for i, feature := range features {
+		if feature.Geometry == nil {
+			continue
+		}
+		zone := geoZone{name: fmt.Sprint(feature.Properties["name"])}
+		if feature.Properties["name"] == nil {
+			zone.name = fmt.Sprintf("zone%d", i+1)
+		}
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+			zone.polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &zone.polygons)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid geoZonesPath coordinates of `%s': %w", zone.name, err)
+		}
+		zones = append(zones, zone)
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no polygons in geoZonesPath `%s'", path)
+	}
+	return zones, nil
+}
+
+// zoneOf returns the name of the first zone containing location, "" when there is none.
+func zoneOf(zones []geoZone, location *coordinate) string {
+	if location == nil {
+		return ""
+	}
+	for _, zone := range zones {
+		for _, polygon := range zone.polygons {
+			if polygonContains(polygon, location.longitude, location.latitude) {
+				return zone.name
+			}
+		}
+	}
+	return ""
+}
+
+// polygonContains reports whether the point x, y lies within the outer ring of polygon
+// and outside of its holes.
+func polygonContains(polygon [][][2]float64, x, y float64) bool {
+	if len(polygon) == 0 || !ringContains(polygon[0], x, y) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains reports whether the point x, y lies within ring, by counting the edges
+// a ray from the point crosses.
+func ringContains(ring [][2]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}